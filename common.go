@@ -1,8 +1,167 @@
 package cloudygcp
 
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/appliedres/cloudy"
+	"google.golang.org/api/impersonate"
+	"google.golang.org/api/option"
+)
+
+// CloudPlatformScope is the default scope used when impersonating a service account
+const CloudPlatformScope = "https://www.googleapis.com/auth/cloud-platform"
+
+// GcpCredentials describes how the GCP clients in this package authenticate. When
+// no key is provided the clients fall back to Application Default Credentials.
 type GcpCredentials struct {
+	// Inline service account JSON key
+	CredentialsJSON string
+	// Path to a service account JSON key file. Ignored when CredentialsJSON is set
+	CredentialsFile string
+	// Service account to impersonate using the base credentials
+	ImpersonateServiceAccount string
+	// Project billed for quota
+	QuotaProject string
+	// OAuth scopes, defaults to the client library defaults
+	Scopes []string
+	// Service account used to sign URLs through the IAM signBlob API when no key is provided.
+	// Defaults to ImpersonateServiceAccount
+	SigningServiceAccount string
+	// Additional options appended after the credential options (endpoints, emulators, etc.)
+	Options []option.ClientOption
 }
 
-func GetCredentialsFromEnv() GcpCredentials {
-	return GcpCredentials{}
+// GetCredentialsFromEnv reads the credential settings from the environment. The
+// following keys are used, all of which are optional:
+//
+//	GCP_CREDENTIALS_JSON        inline service account key
+//	GCP_CREDENTIALS_FILE        path to a service account key file
+//	GCP_IMPERSONATE             service account email to impersonate
+//	GCP_QUOTA_PROJECT           project billed for quota
+//	GCP_SCOPES                  comma separated list of scopes
+//	GCP_SIGNING_SERVICE_ACCOUNT service account used to sign URLs
+func GetCredentialsFromEnv(env *cloudy.Environment) GcpCredentials {
+	creds := GcpCredentials{}
+	if env == nil {
+		return creds
+	}
+	creds.CredentialsJSON = env.Get("GCP_CREDENTIALS_JSON")
+	creds.CredentialsFile = env.Get("GCP_CREDENTIALS_FILE")
+	creds.ImpersonateServiceAccount = env.Get("GCP_IMPERSONATE")
+	creds.QuotaProject = env.Get("GCP_QUOTA_PROJECT")
+	creds.Scopes = splitList(env.Get("GCP_SCOPES"))
+	creds.SigningServiceAccount = env.Get("GCP_SIGNING_SERVICE_ACCOUNT")
+	return creds
+}
+
+// ClientOptions converts the credentials into the options passed to the google client
+// constructors.
+func (c GcpCredentials) ClientOptions(ctx context.Context) ([]option.ClientOption, error) {
+	opts, err := c.credentialOptions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return append(opts, c.Options...), nil
+}
+
+// credentialOptions are the options that authenticate the clients, without the
+// additional Options which may point at the endpoint of a single API
+func (c GcpCredentials) credentialOptions(ctx context.Context) ([]option.ClientOption, error) {
+	var base []option.ClientOption
+	if c.CredentialsJSON != "" {
+		base = append(base, option.WithCredentialsJSON([]byte(c.CredentialsJSON)))
+	} else if c.CredentialsFile != "" {
+		base = append(base, option.WithCredentialsFile(c.CredentialsFile))
+	}
+
+	var opts []option.ClientOption
+	if c.ImpersonateServiceAccount != "" {
+		scopes := c.Scopes
+		if len(scopes) == 0 {
+			scopes = []string{CloudPlatformScope}
+		}
+
+		ts, err := impersonate.CredentialsTokenSource(ctx, impersonate.CredentialsConfig{
+			TargetPrincipal: c.ImpersonateServiceAccount,
+			Scopes:          scopes,
+		}, base...)
+		if err != nil {
+			return nil, cloudy.Error(ctx, "Unable to impersonate %v: %v", c.ImpersonateServiceAccount, err)
+		}
+		opts = append(opts, option.WithTokenSource(ts))
+	} else {
+		opts = append(opts, base...)
+		if len(c.Scopes) > 0 {
+			opts = append(opts, option.WithScopes(c.Scopes...))
+		}
+	}
+
+	if c.QuotaProject != "" {
+		opts = append(opts, option.WithQuotaProject(c.QuotaProject))
+	}
+	return opts, nil
+}
+
+// hasCredentials reports whether credentials are configured, rather than left to
+// Application Default Credentials
+func (c GcpCredentials) hasCredentials() bool {
+	return c.CredentialsJSON != "" || c.CredentialsFile != "" || c.ImpersonateServiceAccount != ""
+}
+
+func splitList(value string) []string {
+	var rtn []string
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			rtn = append(rtn, item)
+		}
+	}
+	return rtn
+}
+
+// runParallel calls fn for each index in [0, count) using at most concurrency goroutines.
+// The context passed to fn is cancelled after the first failure and that error is returned.
+func runParallel(ctx context.Context, count int, concurrency int, fn func(ctx context.Context, i int) error) error {
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	var once sync.Once
+	var firstErr error
+	sem := make(chan struct{}, concurrency)
+
+	for i := 0; i < count; i++ {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if err := fn(ctx, i); err != nil {
+				once.Do(func() {
+					firstErr = err
+					cancel()
+				})
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if firstErr == nil && ctx.Err() != nil {
+		// The parent context was cancelled
+		return ctx.Err()
+	}
+	return firstErr
 }
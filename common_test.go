@@ -0,0 +1,69 @@
+package cloudygcp
+
+import (
+	"testing"
+
+	"github.com/appliedres/cloudy"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetCredentialsFromEnv(t *testing.T) {
+	tests := []struct {
+		name     string
+		env      map[string]string
+		expected GcpCredentials
+	}{
+		{
+			name:     "empty",
+			env:      map[string]string{},
+			expected: GcpCredentials{},
+		},
+		{
+			name: "all keys",
+			env: map[string]string{
+				"GCP_CREDENTIALS_JSON":        `{"type":"service_account"}`,
+				"GCP_CREDENTIALS_FILE":        "/etc/gcp/key.json",
+				"GCP_IMPERSONATE":             "deployer@project.iam.gserviceaccount.com",
+				"GCP_QUOTA_PROJECT":           "billing-project",
+				"GCP_SCOPES":                  "https://www.googleapis.com/auth/devstorage.read_only",
+				"GCP_SIGNING_SERVICE_ACCOUNT": "signer@project.iam.gserviceaccount.com",
+			},
+			expected: GcpCredentials{
+				CredentialsJSON:           `{"type":"service_account"}`,
+				CredentialsFile:           "/etc/gcp/key.json",
+				ImpersonateServiceAccount: "deployer@project.iam.gserviceaccount.com",
+				QuotaProject:              "billing-project",
+				Scopes:                    []string{"https://www.googleapis.com/auth/devstorage.read_only"},
+				SigningServiceAccount:     "signer@project.iam.gserviceaccount.com",
+			},
+		},
+		{
+			name: "scopes are split and trimmed",
+			env: map[string]string{
+				"GCP_SCOPES": " scope-a, scope-b ,,scope-c,",
+			},
+			expected: GcpCredentials{
+				Scopes: []string{"scope-a", "scope-b", "scope-c"},
+			},
+		},
+		{
+			name: "blank scopes",
+			env: map[string]string{
+				"GCP_SCOPES": " , ",
+			},
+			expected: GcpCredentials{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vals := cloudy.NewMapEnvironment()
+			for k, v := range tt.env {
+				vals.Set(k, v)
+			}
+			assert.Equal(t, tt.expected, GetCredentialsFromEnv(cloudy.NewEnvironment(vals)))
+		})
+	}
+
+	assert.Equal(t, GcpCredentials{}, GetCredentialsFromEnv(nil))
+}
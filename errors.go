@@ -0,0 +1,220 @@
+package cloudygcp
+
+import (
+	"encoding/xml"
+	"errors"
+	"net/http"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"github.com/appliedres/cloudy"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Errors returned (wrapped) by the GCP implementations. Not found conditions are
+// reported as cloudy.ErrKeyNotFound. Use errors.Is to test for them.
+var (
+	ErrPermissionDenied   = errors.New("permission denied")
+	ErrUnauthenticated    = errors.New("unauthenticated")
+	ErrAlreadyExists      = errors.New("already exists")
+	ErrPreconditionFailed = errors.New("precondition failed")
+	ErrRateLimited        = errors.New("rate limited")
+	ErrUnavailable        = errors.New("service unavailable")
+	ErrChecksumMismatch   = errors.New("checksum mismatch")
+	ErrEncryptionKey      = errors.New("missing or incorrect encryption key")
+)
+
+// IsNotFound reports whether the error indicates a missing bucket, object or secret
+func IsNotFound(err error) bool {
+	return isErrorKind(err, cloudy.ErrKeyNotFound)
+}
+
+// IsForbidden reports whether the caller lacks permission for the operation
+func IsForbidden(err error) bool {
+	return isErrorKind(err, ErrPermissionDenied)
+}
+
+// IsPreconditionFailed reports whether a generation or metageneration precondition failed
+func IsPreconditionFailed(err error) bool {
+	return isErrorKind(err, ErrPreconditionFailed)
+}
+
+// IsRateLimited reports whether the request was rejected because of rate limits or quota
+func IsRateLimited(err error) bool {
+	return isErrorKind(err, ErrRateLimited)
+}
+
+func isErrorKind(err error, kind error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, kind) {
+		return true
+	}
+	if storageErrorKind(err) == kind {
+		return true
+	}
+	return grpcErrorKind(grpcCode(err)) == kind
+}
+
+// gcpError associates an error returned by a google client with one of the
+// sentinel errors while keeping the original error available to errors.As
+type gcpError struct {
+	kind error
+	err  error
+}
+
+func (e *gcpError) Error() string {
+	return e.err.Error()
+}
+
+func (e *gcpError) Is(target error) bool {
+	return target == e.kind
+}
+
+func (e *gcpError) Unwrap() error {
+	return e.err
+}
+
+func newGcpError(kind error, err error) error {
+	if kind == nil || err == nil {
+		return err
+	}
+	return &gcpError{kind: kind, err: err}
+}
+
+// grpcErrorKind maps a gRPC status code onto one of the sentinel errors
+func grpcErrorKind(code codes.Code) error {
+	switch code {
+	case codes.NotFound:
+		return cloudy.ErrKeyNotFound
+	case codes.PermissionDenied:
+		return ErrPermissionDenied
+	case codes.Unauthenticated:
+		return ErrUnauthenticated
+	case codes.AlreadyExists:
+		return ErrAlreadyExists
+	case codes.FailedPrecondition, codes.Aborted:
+		return ErrPreconditionFailed
+	case codes.ResourceExhausted:
+		return ErrRateLimited
+	case codes.Unavailable, codes.DeadlineExceeded:
+		return ErrUnavailable
+	}
+	return nil
+}
+
+// classifyGrpcError wraps an error returned by a gRPC based client (Secret Manager)
+// so that callers can test it with errors.Is against the sentinel errors.
+func classifyGrpcError(err error) error {
+	if err == nil {
+		return nil
+	}
+	var already *gcpError
+	if errors.As(err, &already) {
+		return err
+	}
+	return newGcpError(grpcErrorKind(grpcCode(err)), err)
+}
+
+// grpcCode finds the gRPC status code of an error, looking through wrapped errors
+func grpcCode(err error) codes.Code {
+	var se interface{ GRPCStatus() *status.Status }
+	if errors.As(err, &se) {
+		return se.GRPCStatus().Code()
+	}
+	return status.Code(err)
+}
+
+// storageErrorKind maps an error returned by the Cloud Storage client onto one of the
+// sentinel errors
+func storageErrorKind(err error) error {
+	if errors.Is(err, storage.ErrBucketNotExist) || errors.Is(err, storage.ErrObjectNotExist) {
+		return cloudy.ErrKeyNotFound
+	}
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		if isEncryptionKeyError(apiErr) {
+			return ErrEncryptionKey
+		}
+		return httpErrorKind(apiErr.Code)
+	}
+	return nil
+}
+
+// encryptionKeyReasons are the reasons GCS gives to customer-supplied key failures
+var encryptionKeyReasons = []string{
+	"customerEncryptionAlgorithmIsInvalid",
+	"customerEncryptionKeyFormatIsInvalid",
+	"customerEncryptionKeyIsIncorrect",
+	"customerEncryptionKeySha256IsInvalid",
+	"resourceIsEncryptedWithCustomerEncryptionKey",
+	"resourceNotEncryptedWithCustomerEncryptionKey",
+}
+
+// xmlError is the error document of the XML API
+type xmlError struct {
+	Code string `xml:"Code"`
+}
+
+// isEncryptionKeyError detects the customer-supplied key failures, which GCS reports
+// as bad requests. The JSON API sets the reason of the errors, the XML API (used for
+// reads) uses it as the code of its error document, capitalized.
+func isEncryptionKeyError(apiErr *googleapi.Error) bool {
+	if apiErr.Code != http.StatusBadRequest && apiErr.Code != http.StatusForbidden {
+		return false
+	}
+	reasons := make([]string, 0, len(apiErr.Errors)+1)
+	for _, item := range apiErr.Errors {
+		reasons = append(reasons, item.Reason)
+	}
+	doc := &xmlError{}
+	if strings.HasPrefix(strings.TrimSpace(apiErr.Body), "<") && xml.Unmarshal([]byte(apiErr.Body), doc) == nil {
+		reasons = append(reasons, doc.Code)
+	}
+
+	for _, reason := range reasons {
+		for _, known := range encryptionKeyReasons {
+			if strings.EqualFold(reason, known) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// httpErrorKind maps an HTTP status code returned by the JSON / XML APIs
+func httpErrorKind(code int) error {
+	switch code {
+	case http.StatusNotFound:
+		return cloudy.ErrKeyNotFound
+	case http.StatusForbidden:
+		return ErrPermissionDenied
+	case http.StatusUnauthorized:
+		return ErrUnauthenticated
+	case http.StatusConflict:
+		return ErrAlreadyExists
+	case http.StatusPreconditionFailed:
+		return ErrPreconditionFailed
+	case http.StatusTooManyRequests:
+		return ErrRateLimited
+	case http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return ErrUnavailable
+	}
+	return nil
+}
+
+// classifyStorageError wraps an error returned by the Cloud Storage client so that
+// callers can test it with errors.Is against the sentinel errors.
+func classifyStorageError(err error) error {
+	if err == nil {
+		return nil
+	}
+	var already *gcpError
+	if errors.As(err, &already) {
+		return err
+	}
+	return newGcpError(storageErrorKind(err), err)
+}
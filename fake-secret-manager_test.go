@@ -0,0 +1,362 @@
+package cloudygcp
+
+import (
+	"context"
+	"fmt"
+	"hash/crc32"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/secretmanager/apiv1/secretmanagerpb"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// fakeSecretManager is an in-process, in-memory implementation of the Secret Manager
+// gRPC service. Only the calls used by this package are implemented.
+type fakeSecretManager struct {
+	secretmanagerpb.UnimplementedSecretManagerServiceServer
+
+	mu       sync.Mutex
+	secrets  map[string]*fakeSecret
+	failures map[string]codes.Code
+	// Number of ListSecrets calls
+	listRequests int
+	// Leave out the payload checksums, as for versions added without one
+	omitChecksums bool
+}
+
+type fakeSecret struct {
+	secret   *secretmanagerpb.Secret
+	versions []*fakeSecretVersion
+}
+
+type fakeSecretVersion struct {
+	version *secretmanagerpb.SecretVersion
+	data    []byte
+}
+
+// startFakeSecretManager starts the fake server and returns a SecretManager connected to it
+func startFakeSecretManager(t *testing.T, project string) (*fakeSecretManager, *SecretManager) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+
+	fake := &fakeSecretManager{
+		secrets:  make(map[string]*fakeSecret),
+		failures: make(map[string]codes.Code),
+	}
+	srv := grpc.NewServer()
+	secretmanagerpb.RegisterSecretManagerServiceServer(srv, fake)
+	go func() {
+		_ = srv.Serve(lis)
+	}()
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+
+	sm, err := NewSecretManager(context.Background(), project, GcpCredentials{
+		Options: []option.ClientOption{option.WithGRPCConn(conn)},
+	})
+	if err != nil {
+		t.Fatalf("NewSecretManager: %v", err)
+	}
+	t.Cleanup(func() {
+		sm.Client.Close()
+	})
+	return fake, sm
+}
+
+// fail makes every call to method for the given resource name return the code
+func (f *fakeSecretManager) fail(method string, name string, code codes.Code) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failures[method+":"+name] = code
+}
+
+// setOmitChecksums leaves out (or returns again) the payload checksums of accessed versions
+func (f *fakeSecretManager) setOmitChecksums(omit bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.omitChecksums = omit
+}
+
+func (f *fakeSecretManager) failure(method string, name string) error {
+	if code, ok := f.failures[method+":"+name]; ok {
+		return status.Errorf(code, "injected %v failure for %v", method, name)
+	}
+	return nil
+}
+
+// splitVersionName splits projects/p/secrets/s/versions/v into the secret name and version
+func splitVersionName(name string) (string, string) {
+	i := strings.LastIndex(name, "/versions/")
+	if i < 0 {
+		return name, ""
+	}
+	return name[:i], name[i+len("/versions/"):]
+}
+
+func (f *fakeSecretManager) findVersion(name string) (*fakeSecretVersion, error) {
+	secretName, v := splitVersionName(name)
+	s, ok := f.secrets[secretName]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "secret %v not found", secretName)
+	}
+	// Like the real service, latest is the newest version whatever its state
+	if v == "latest" {
+		if len(s.versions) == 0 {
+			return nil, status.Errorf(codes.NotFound, "no versions of %v", secretName)
+		}
+		return s.versions[len(s.versions)-1], nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 || n > len(s.versions) {
+		return nil, status.Errorf(codes.NotFound, "version %v not found", name)
+	}
+	return s.versions[n-1], nil
+}
+
+func (f *fakeSecretManager) GetSecret(ctx context.Context, req *secretmanagerpb.GetSecretRequest) (*secretmanagerpb.Secret, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.failure("GetSecret", req.Name); err != nil {
+		return nil, err
+	}
+	s, ok := f.secrets[req.Name]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "secret %v not found", req.Name)
+	}
+	return s.secret, nil
+}
+
+func (f *fakeSecretManager) CreateSecret(ctx context.Context, req *secretmanagerpb.CreateSecretRequest) (*secretmanagerpb.Secret, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	name := fmt.Sprintf("%v/secrets/%v", req.Parent, req.SecretId)
+	if err := f.failure("CreateSecret", name); err != nil {
+		return nil, err
+	}
+	if _, ok := f.secrets[name]; ok {
+		return nil, status.Errorf(codes.AlreadyExists, "secret %v already exists", name)
+	}
+	secret := &secretmanagerpb.Secret{
+		Name:        name,
+		Replication: req.Secret.GetReplication(),
+		Labels:      req.Secret.GetLabels(),
+		CreateTime:  timestamppb.Now(),
+	}
+	f.secrets[name] = &fakeSecret{secret: secret}
+	return secret, nil
+}
+
+func (f *fakeSecretManager) AddSecretVersion(ctx context.Context, req *secretmanagerpb.AddSecretVersionRequest) (*secretmanagerpb.SecretVersion, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.failure("AddSecretVersion", req.Parent); err != nil {
+		return nil, err
+	}
+	s, ok := f.secrets[req.Parent]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "secret %v not found", req.Parent)
+	}
+	v := &secretmanagerpb.SecretVersion{
+		Name:       fmt.Sprintf("%v/versions/%v", req.Parent, len(s.versions)+1),
+		CreateTime: timestamppb.Now(),
+		State:      secretmanagerpb.SecretVersion_ENABLED,
+	}
+	s.versions = append(s.versions, &fakeSecretVersion{version: v, data: req.Payload.GetData()})
+	return v, nil
+}
+
+func (f *fakeSecretManager) AccessSecretVersion(ctx context.Context, req *secretmanagerpb.AccessSecretVersionRequest) (*secretmanagerpb.AccessSecretVersionResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	secretName, _ := splitVersionName(req.Name)
+	if err := f.failure("AccessSecretVersion", secretName); err != nil {
+		return nil, err
+	}
+	v, err := f.findVersion(req.Name)
+	if err != nil {
+		return nil, err
+	}
+	if v.version.State != secretmanagerpb.SecretVersion_ENABLED {
+		return nil, status.Errorf(codes.FailedPrecondition, "version %v is %v", v.version.Name, v.version.State)
+	}
+	payload := &secretmanagerpb.SecretPayload{Data: v.data}
+	if !f.omitChecksums {
+		checksum := int64(crc32.Checksum(v.data, crc32.MakeTable(crc32.Castagnoli)))
+		payload.DataCrc32C = &checksum
+	}
+	return &secretmanagerpb.AccessSecretVersionResponse{
+		Name:    v.version.Name,
+		Payload: payload,
+	}, nil
+}
+
+func (f *fakeSecretManager) DeleteSecret(ctx context.Context, req *secretmanagerpb.DeleteSecretRequest) (*emptypb.Empty, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.failure("DeleteSecret", req.Name); err != nil {
+		return nil, err
+	}
+	if _, ok := f.secrets[req.Name]; !ok {
+		return nil, status.Errorf(codes.NotFound, "secret %v not found", req.Name)
+	}
+	delete(f.secrets, req.Name)
+	return &emptypb.Empty{}, nil
+}
+
+// ListSecretVersions returns the versions newest first, one page of PageSize at a time
+func (f *fakeSecretManager) ListSecretVersions(ctx context.Context, req *secretmanagerpb.ListSecretVersionsRequest) (*secretmanagerpb.ListSecretVersionsResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.failure("ListSecretVersions", req.Parent); err != nil {
+		return nil, err
+	}
+	s, ok := f.secrets[req.Parent]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "secret %v not found", req.Parent)
+	}
+
+	var versions []*secretmanagerpb.SecretVersion
+	for i := len(s.versions) - 1; i >= 0; i-- {
+		versions = append(versions, s.versions[i].version)
+	}
+	page, next := fakePage(len(versions), req.PageSize, req.PageToken)
+	return &secretmanagerpb.ListSecretVersionsResponse{
+		Versions:      versions[page[0]:page[1]],
+		NextPageToken: next,
+		TotalSize:     int32(len(versions)),
+	}, nil
+}
+
+// fakePage returns the bounds of the page of a list of n items and the next page token
+func fakePage(n int, size int32, token string) ([2]int, string) {
+	start, _ := strconv.Atoi(token)
+	end := n
+	if size > 0 && start+int(size) < n {
+		end = start + int(size)
+	}
+	if start > end {
+		start = end
+	}
+	next := ""
+	if end < n {
+		next = strconv.Itoa(end)
+	}
+	return [2]int{start, end}, next
+}
+
+func (f *fakeSecretManager) setVersionState(method string, name string, state secretmanagerpb.SecretVersion_State) (*secretmanagerpb.SecretVersion, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	secretName, _ := splitVersionName(name)
+	if err := f.failure(method, secretName); err != nil {
+		return nil, err
+	}
+	v, err := f.findVersion(name)
+	if err != nil {
+		return nil, err
+	}
+	if v.version.State == secretmanagerpb.SecretVersion_DESTROYED {
+		return nil, status.Errorf(codes.FailedPrecondition, "version %v is destroyed", name)
+	}
+	v.version.State = state
+	if state == secretmanagerpb.SecretVersion_DESTROYED {
+		v.version.DestroyTime = timestamppb.Now()
+		v.data = nil
+	}
+	return v.version, nil
+}
+
+func (f *fakeSecretManager) DisableSecretVersion(ctx context.Context, req *secretmanagerpb.DisableSecretVersionRequest) (*secretmanagerpb.SecretVersion, error) {
+	return f.setVersionState("DisableSecretVersion", req.Name, secretmanagerpb.SecretVersion_DISABLED)
+}
+
+func (f *fakeSecretManager) EnableSecretVersion(ctx context.Context, req *secretmanagerpb.EnableSecretVersionRequest) (*secretmanagerpb.SecretVersion, error) {
+	return f.setVersionState("EnableSecretVersion", req.Name, secretmanagerpb.SecretVersion_ENABLED)
+}
+
+func (f *fakeSecretManager) DestroySecretVersion(ctx context.Context, req *secretmanagerpb.DestroySecretVersionRequest) (*secretmanagerpb.SecretVersion, error) {
+	return f.setVersionState("DestroySecretVersion", req.Name, secretmanagerpb.SecretVersion_DESTROYED)
+}
+
+// ListSecrets supports the filter terms built by ListSecretsOptions, joined with AND
+func (f *fakeSecretManager) ListSecrets(ctx context.Context, req *secretmanagerpb.ListSecretsRequest) (*secretmanagerpb.ListSecretsResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.failure("ListSecrets", req.Parent); err != nil {
+		return nil, err
+	}
+	f.listRequests++
+
+	var secrets []*secretmanagerpb.Secret
+	for name, s := range f.secrets {
+		if !strings.HasPrefix(name, req.Parent+"/secrets/") {
+			continue
+		}
+		ok, err := fakeFilterMatches(s.secret, req.Filter)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			secrets = append(secrets, s.secret)
+		}
+	}
+	sort.Slice(secrets, func(i, j int) bool {
+		return secrets[i].Name < secrets[j].Name
+	})
+
+	page, next := fakePage(len(secrets), req.PageSize, req.PageToken)
+	return &secretmanagerpb.ListSecretsResponse{
+		Secrets:       secrets[page[0]:page[1]],
+		NextPageToken: next,
+		TotalSize:     int32(len(secrets)),
+	}, nil
+}
+
+func fakeFilterMatches(s *secretmanagerpb.Secret, filter string) (bool, error) {
+	if filter == "" {
+		return true, nil
+	}
+	for _, term := range strings.Split(filter, " AND ") {
+		switch {
+		case strings.HasPrefix(term, "name:"):
+			if !strings.Contains(s.Name, strings.TrimPrefix(term, "name:")) {
+				return false, nil
+			}
+		case strings.HasPrefix(term, "labels."):
+			kv := strings.SplitN(strings.TrimPrefix(term, "labels."), "=", 2)
+			if len(kv) != 2 || s.Labels[kv[0]] != kv[1] {
+				return false, nil
+			}
+		case strings.HasPrefix(term, "create_time>"), strings.HasPrefix(term, "create_time<"):
+			t, err := time.Parse(time.RFC3339, term[len("create_time>"):])
+			if err != nil {
+				return false, status.Errorf(codes.InvalidArgument, "invalid filter %q", term)
+			}
+			created := s.CreateTime.AsTime()
+			if term[len("create_time")] == '>' && !created.After(t) || term[len("create_time")] == '<' && !created.Before(t) {
+				return false, nil
+			}
+		default:
+			return false, status.Errorf(codes.InvalidArgument, "unsupported filter %q", term)
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,1071 @@
+package cloudygcp
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/appliedres/cloudy"
+	"google.golang.org/api/option"
+	raw "google.golang.org/api/storage/v1"
+)
+
+// fakeStorage is an in-memory implementation of the parts of the Cloud Storage JSON and
+// XML APIs used by this package. The storage client is pointed at it through
+// STORAGE_EMULATOR_HOST, in the same way as the official emulator.
+type fakeStorage struct {
+	mu       sync.Mutex
+	server   *httptest.Server
+	buckets  map[string]*fakeBucket
+	sessions map[string]*fakeUploadSession
+	nextGen  int64
+	nextID   int
+	requests map[string]int
+
+	// Status returned by compose requests, zero to compose normally
+	composeError int
+	// Largest number of sources seen in a single compose
+	maxComposeSources int
+	// Flip the bits of the first byte served by ranged reads starting at this offset
+	corruptOffset int64
+	// Bytes copied by each rewrite request, zero to complete rewrites in one request
+	rewriteChunk int
+	// Number of IAM policy writes rejected as if another writer changed the policy first
+	staleIAMWrites int
+	// Status returned by bucket patches, zero to patch normally
+	patchBucketError int
+	// Query of the last object listing
+	lastListQuery url.Values
+	// Status returned when deleting the named objects
+	deleteErrors map[string]int
+	// Status returned when reading the IAM policy of the named buckets
+	policyReadErrors map[string]int
+}
+
+type fakeBucket struct {
+	name           string
+	created        time.Time
+	metageneration int64
+	// Fields of the bucket resource set through patch requests
+	fields  map[string]interface{}
+	objects map[string]*fakeObject
+	// Noncurrent generations of versioned buckets, oldest first
+	noncurrent map[string][]*fakeObject
+	// IAM policy, its etag is derived from the number of writes
+	bindings     []*raw.PolicyBindings
+	policyWrites int
+}
+
+type fakeObject struct {
+	bucket         string
+	name           string
+	data           []byte
+	contentType    string
+	metadata       map[string]string
+	generation     int64
+	metageneration int64
+	created        time.Time
+	updated        time.Time
+	// When the generation became noncurrent
+	deleted time.Time
+	// Hash of the customer-supplied key or KMS key name the object is encrypted with
+	keySHA256  string
+	kmsKeyName string
+}
+
+type fakeUploadSession struct {
+	bucket string
+	object *fakeObject
+	conds  url.Values
+	data   []byte
+}
+
+// startFakeStorage starts the fake server and returns a GoogleCloudStorage connected to it
+func startFakeStorage(t *testing.T) (*fakeStorage, *GoogleCloudStorage) {
+	fake := &fakeStorage{
+		buckets:       make(map[string]*fakeBucket),
+		sessions:      make(map[string]*fakeUploadSession),
+		nextGen:       1000,
+		requests:      make(map[string]int),
+		corruptOffset: -1,
+	}
+	fake.server = httptest.NewServer(http.HandlerFunc(fake.serveHTTP))
+	t.Cleanup(fake.server.Close)
+	t.Setenv("STORAGE_EMULATOR_HOST", fake.server.URL)
+
+	gcs, err := NewGoogleCloudStorage(cloudy.StartContext(), "test-project", GcpCredentials{
+		Options: []option.ClientOption{option.WithoutAuthentication()},
+	})
+	if err != nil {
+		t.Fatalf("NewGoogleCloudStorage: %v", err)
+	}
+	t.Cleanup(func() {
+		gcs.Client.Close()
+	})
+	return fake, gcs
+}
+
+// createBucket adds an empty bucket and returns a handle to it
+func (f *fakeStorage) createBucket(gcs *GoogleCloudStorage, name string) *GoogleCloudStorageBucket {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.buckets[name] = newFakeBucket(name)
+	return gcs.bucket(name)
+}
+
+func newFakeBucket(name string) *fakeBucket {
+	return &fakeBucket{
+		name:           name,
+		created:        time.Now().UTC(),
+		metageneration: 1,
+		fields:         make(map[string]interface{}),
+		objects:        make(map[string]*fakeObject),
+		noncurrent:     make(map[string][]*fakeObject),
+	}
+}
+
+// object returns the live object, or nil
+func (f *fakeStorage) object(bucket string, name string) *fakeObject {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	b, ok := f.buckets[bucket]
+	if !ok {
+		return nil
+	}
+	return b.objects[name]
+}
+
+// objectNames returns the sorted names of the live objects in the bucket
+func (f *fakeStorage) objectNames(bucket string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var names []string
+	for name := range f.buckets[bucket].objects {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// requestCount returns how many requests were made for the method and path prefix
+func (f *fakeStorage) requestCount(method string, prefix string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	count := 0
+	for k, v := range f.requests {
+		if strings.HasPrefix(k, method+" "+prefix) {
+			count += v
+		}
+	}
+	return count
+}
+
+func (f *fakeStorage) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	path := r.URL.EscapedPath()
+	f.requests[r.Method+" "+path]++
+
+	switch {
+	case strings.HasPrefix(path, "/upload/storage/v1/b/"):
+		f.serveUpload(w, r, strings.TrimPrefix(path, "/upload/storage/v1/b/"))
+	case strings.HasPrefix(path, "/storage/v1/b"):
+		f.serveJSON(w, r, strings.TrimPrefix(strings.TrimPrefix(path, "/storage/v1/b"), "/"))
+	default:
+		f.serveXMLRead(w, r, strings.TrimPrefix(path, "/"))
+	}
+}
+
+// splitPath splits an escaped path into unescaped segments
+func splitPath(path string) []string {
+	var parts []string
+	for _, p := range strings.Split(path, "/") {
+		u, err := url.PathUnescape(p)
+		if err != nil {
+			u = p
+		}
+		parts = append(parts, u)
+	}
+	return parts
+}
+
+func writeFakeError(w http.ResponseWriter, code int, format string, args ...interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": map[string]interface{}{
+			"code":    code,
+			"message": fmt.Sprintf(format, args...),
+		},
+	})
+}
+
+// writeFakeReason writes a JSON API error carrying a reason, like the errors GCS
+// classifies beyond the status code
+func writeFakeReason(w http.ResponseWriter, code int, reason string, format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": map[string]interface{}{
+			"code":    code,
+			"message": message,
+			"errors": []map[string]string{
+				{"domain": "global", "reason": reason, "message": message},
+			},
+		},
+	})
+}
+
+func writeFakeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func (f *fakeStorage) serveJSON(w http.ResponseWriter, r *http.Request, path string) {
+	parts := splitPath(path)
+	if path == "" && r.Method == http.MethodPost {
+		f.insertBucket(w, r)
+		return
+	}
+	if path == "" && r.Method == http.MethodGet {
+		f.listBuckets(w)
+		return
+	}
+	if path == "" {
+		writeFakeError(w, http.StatusNotImplemented, "%v bucket collection not implemented", r.Method)
+		return
+	}
+
+	b, ok := f.buckets[parts[0]]
+	if !ok {
+		writeFakeError(w, http.StatusNotFound, "bucket %v not found", parts[0])
+		return
+	}
+
+	switch {
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		writeFakeJSON(w, b.resource())
+	case len(parts) == 1 && r.Method == http.MethodPatch:
+		f.patchBucket(w, r, b)
+	case len(parts) == 1 && r.Method == http.MethodDelete:
+		if len(b.objects) > 0 || len(b.noncurrent) > 0 {
+			writeFakeError(w, http.StatusConflict, "bucket %v is not empty", b.name)
+			return
+		}
+		delete(f.buckets, b.name)
+		w.WriteHeader(http.StatusNoContent)
+	case len(parts) == 2 && parts[1] == "iam" && r.Method == http.MethodGet:
+		f.getPolicy(w, r, b)
+	case len(parts) == 2 && parts[1] == "iam" && r.Method == http.MethodPut:
+		f.setPolicy(w, r, b)
+	case len(parts) == 2 && parts[1] == "o" && r.Method == http.MethodGet:
+		f.listObjects(w, r, b)
+	case len(parts) == 3 && parts[1] == "o":
+		f.serveObject(w, r, b, parts[2])
+	case len(parts) == 4 && parts[1] == "o" && parts[3] == "compose" && r.Method == http.MethodPost:
+		f.compose(w, r, b, parts[2])
+	case len(parts) == 8 && parts[1] == "o" && parts[3] == "rewriteTo" && r.Method == http.MethodPost:
+		f.rewrite(w, r, b, parts[2], parts[5], parts[7])
+	default:
+		writeFakeError(w, http.StatusNotImplemented, "%v %v not implemented", r.Method, r.URL.Path)
+	}
+}
+
+func (f *fakeStorage) serveObject(w http.ResponseWriter, r *http.Request, b *fakeBucket, name string) {
+	o := b.find(name, r.URL.Query().Get("generation"))
+	if o == nil {
+		writeFakeError(w, http.StatusNotFound, "object %v not found", name)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		if r.URL.Query().Get("alt") == "media" {
+			if checkFakeKey(w, o, r.Header.Get("X-Goog-Encryption-Key-Sha256")) {
+				_, _ = w.Write(o.data)
+			}
+			return
+		}
+		writeFakeJSON(w, o.resource())
+	case http.MethodDelete:
+		if code := f.deleteErrors[name]; code != 0 {
+			writeFakeError(w, code, "injected delete failure of %v", name)
+			return
+		}
+		if m := r.URL.Query().Get("ifGenerationMatch"); m != "" && m != strconv.FormatInt(o.generation, 10) {
+			writeFakeError(w, http.StatusPreconditionFailed, "generation %v does not match", m)
+			return
+		}
+		b.remove(o, r.URL.Query().Get("generation") != "")
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeFakeError(w, http.StatusNotImplemented, "%v %v not implemented", r.Method, r.URL.Path)
+	}
+}
+
+func (f *fakeStorage) compose(w http.ResponseWriter, r *http.Request, b *fakeBucket, name string) {
+	if f.composeError != 0 {
+		writeFakeError(w, f.composeError, "injected compose failure")
+		return
+	}
+
+	var req struct {
+		Destination struct {
+			ContentType string            `json:"contentType"`
+			Metadata    map[string]string `json:"metadata"`
+		} `json:"destination"`
+		SourceObjects []struct {
+			Name string `json:"name"`
+		} `json:"sourceObjects"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeFakeError(w, http.StatusBadRequest, "invalid compose request: %v", err)
+		return
+	}
+	if len(req.SourceObjects) > MaxComposeComponents {
+		writeFakeError(w, http.StatusBadRequest, "too many source objects %v", len(req.SourceObjects))
+		return
+	}
+	if len(req.SourceObjects) > f.maxComposeSources {
+		f.maxComposeSources = len(req.SourceObjects)
+	}
+
+	o := &fakeObject{
+		name:        name,
+		contentType: req.Destination.ContentType,
+		metadata:    req.Destination.Metadata,
+	}
+	o.setEncryption(r)
+	for _, src := range req.SourceObjects {
+		so, ok := b.objects[src.Name]
+		if !ok {
+			writeFakeError(w, http.StatusNotFound, "source %v not found", src.Name)
+			return
+		}
+		o.data = append(o.data, so.data...)
+	}
+
+	o, code, err := f.finalize(b, o, r.URL.Query())
+	if err != nil {
+		writeFakeError(w, code, "%v", err)
+		return
+	}
+	writeFakeJSON(w, o.resource())
+}
+
+// rewrite copies an object, within the bucket or to another one
+func (f *fakeStorage) rewrite(w http.ResponseWriter, r *http.Request, b *fakeBucket, name string, dstBucket string, dstName string) {
+	q := r.URL.Query()
+	src := b.find(name, q.Get("sourceGeneration"))
+	if src == nil {
+		writeFakeError(w, http.StatusNotFound, "object %v not found", name)
+		return
+	}
+	if !checkFakeKey(w, src, r.Header.Get("X-Goog-Copy-Source-Encryption-Key-Sha256")) {
+		return
+	}
+	db, ok := f.buckets[dstBucket]
+	if !ok {
+		writeFakeError(w, http.StatusNotFound, "bucket %v not found", dstBucket)
+		return
+	}
+
+	// The rewrite token is the number of bytes already copied
+	copied, _ := strconv.Atoi(q.Get("rewriteToken"))
+	if f.rewriteChunk > 0 && copied+f.rewriteChunk < len(src.data) {
+		copied += f.rewriteChunk
+		writeFakeJSON(w, map[string]interface{}{
+			"kind":                "storage#rewriteResponse",
+			"totalBytesRewritten": strconv.Itoa(copied),
+			"objectSize":          strconv.Itoa(len(src.data)),
+			"done":                false,
+			"rewriteToken":        strconv.Itoa(copied),
+		})
+		return
+	}
+
+	dst := &fakeObject{}
+	if err := decodeFakeObject(r.Body, dst); err != nil {
+		writeFakeError(w, http.StatusBadRequest, "invalid rewrite request: %v", err)
+		return
+	}
+	dst.name = dstName
+	dst.data = src.data
+	dst.setEncryption(r)
+	if dst.contentType == "" {
+		dst.contentType = src.contentType
+	}
+	if dst.metadata == nil {
+		dst.metadata = src.metadata
+	}
+
+	o, code, err := f.finalize(db, dst, q)
+	if err != nil {
+		writeFakeError(w, code, "%v", err)
+		return
+	}
+	writeFakeJSON(w, map[string]interface{}{
+		"kind":                "storage#rewriteResponse",
+		"totalBytesRewritten": strconv.Itoa(len(o.data)),
+		"objectSize":          strconv.Itoa(len(o.data)),
+		"done":                true,
+		"resource":            o.resource(),
+	})
+}
+
+func (f *fakeStorage) listObjects(w http.ResponseWriter, r *http.Request, b *fakeBucket) {
+	q := r.URL.Query()
+	f.lastListQuery = q
+	prefix := q.Get("prefix")
+	delimiter := q.Get("delimiter")
+	start := q.Get("startOffset")
+	end := q.Get("endOffset")
+	versions := q.Get("versions") == "true"
+
+	var names []string
+	for name := range b.objects {
+		names = append(names, name)
+	}
+	if versions {
+		for name := range b.noncurrent {
+			if _, ok := b.objects[name]; !ok {
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+
+	// Entries are either objects or prefixes, in name order
+	type entry struct {
+		name   string
+		prefix bool
+	}
+	var entries []entry
+	seen := make(map[string]bool)
+	for _, name := range names {
+		if !strings.HasPrefix(name, prefix) || (start != "" && name < start) || (end != "" && name >= end) {
+			continue
+		}
+		if delimiter != "" {
+			if i := strings.Index(name[len(prefix):], delimiter); i >= 0 {
+				p := name[:len(prefix)+i+len(delimiter)]
+				if !seen[p] {
+					seen[p] = true
+					entries = append(entries, entry{name: p, prefix: true})
+				}
+				continue
+			}
+		}
+		entries = append(entries, entry{name: name})
+	}
+
+	// The page token is the name of the first entry of the page
+	if token := q.Get("pageToken"); token != "" {
+		for len(entries) > 0 && entries[0].name < token {
+			entries = entries[1:]
+		}
+	}
+	next := ""
+	if max, _ := strconv.Atoi(q.Get("maxResults")); max > 0 && len(entries) > max {
+		next = entries[max].name
+		entries = entries[:max]
+	}
+
+	items := []interface{}{}
+	prefixes := []string{}
+	for _, e := range entries {
+		if e.prefix {
+			prefixes = append(prefixes, e.name)
+			continue
+		}
+		if versions {
+			for _, o := range b.noncurrent[e.name] {
+				items = append(items, o.resource())
+			}
+		}
+		if o, ok := b.objects[e.name]; ok {
+			items = append(items, o.resource())
+		}
+	}
+
+	writeFakeJSON(w, map[string]interface{}{
+		"kind":          "storage#objects",
+		"items":         items,
+		"prefixes":      prefixes,
+		"nextPageToken": next,
+	})
+}
+
+// serveXMLRead implements object reads through the XML API, which the client uses for downloads
+func (f *fakeStorage) serveXMLRead(w http.ResponseWriter, r *http.Request, path string) {
+	parts := strings.SplitN(path, "/", 2)
+	if len(parts) != 2 {
+		writeFakeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	bucket, _ := url.PathUnescape(parts[0])
+	name, _ := url.PathUnescape(parts[1])
+
+	b, ok := f.buckets[bucket]
+	if !ok {
+		writeFakeError(w, http.StatusNotFound, "bucket %v not found", bucket)
+		return
+	}
+	o := b.find(name, r.URL.Query().Get("generation"))
+	if o == nil {
+		writeFakeError(w, http.StatusNotFound, "object %v not found", name)
+		return
+	}
+	if reason := fakeKeyReason(o, r.Header.Get("X-Goog-Encryption-Key-Sha256")); reason != "" {
+		// The XML API reports the reason as the error code, capitalized
+		w.Header().Set("Content-Type", "application/xml; charset=UTF-8")
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "<?xml version='1.0' encoding='UTF-8'?><Error><Code>%v</Code><Message>customer-supplied encryption key check failed</Message></Error>",
+			strings.ToUpper(reason[:1])+reason[1:])
+		return
+	}
+
+	h := w.Header()
+	h.Set("Content-Type", o.contentType)
+	h.Set("X-Goog-Generation", strconv.FormatInt(o.generation, 10))
+	h.Set("X-Goog-Metageneration", strconv.FormatInt(o.metageneration, 10))
+	h.Set("Last-Modified", o.updated.UTC().Format(http.TimeFormat))
+	h.Add("X-Goog-Hash", "crc32c="+o.crc32c())
+	h.Add("X-Goog-Hash", "md5="+o.md5())
+
+	size := int64(len(o.data))
+	rng := r.Header.Get("Range")
+	if rng == "" {
+		h.Set("Content-Length", strconv.FormatInt(size, 10))
+		if r.Method != http.MethodHead {
+			_, _ = w.Write(o.data)
+		}
+		return
+	}
+
+	start, end, ok := parseFakeRange(rng, size)
+	if !ok {
+		writeFakeError(w, http.StatusRequestedRangeNotSatisfiable, "invalid range %v", rng)
+		return
+	}
+	h.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, size))
+	h.Set("Content-Length", strconv.FormatInt(end-start+1, 10))
+	w.WriteHeader(http.StatusPartialContent)
+	if r.Method != http.MethodHead {
+		data := append([]byte{}, o.data[start:end+1]...)
+		if start == f.corruptOffset {
+			data[0] ^= 0xff
+		}
+		_, _ = w.Write(data)
+	}
+}
+
+// parseFakeRange parses "bytes=a-b", "bytes=a-" and "bytes=-n"
+func parseFakeRange(rng string, size int64) (int64, int64, bool) {
+	spec := strings.TrimPrefix(rng, "bytes=")
+	dash := strings.Index(spec, "-")
+	if dash < 0 {
+		return 0, 0, false
+	}
+	first, last := spec[:dash], spec[dash+1:]
+	if first == "" {
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil {
+			return 0, 0, false
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, size - 1, true
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start >= size {
+		return 0, 0, false
+	}
+	end := size - 1
+	if last != "" {
+		end, err = strconv.ParseInt(last, 10, 64)
+		if err != nil {
+			return 0, 0, false
+		}
+		if end >= size {
+			end = size - 1
+		}
+	}
+	return start, end, true
+}
+
+func (f *fakeStorage) serveUpload(w http.ResponseWriter, r *http.Request, path string) {
+	parts := splitPath(path)
+	b, ok := f.buckets[parts[0]]
+	if !ok {
+		writeFakeError(w, http.StatusNotFound, "bucket %v not found", parts[0])
+		return
+	}
+
+	q := r.URL.Query()
+	switch {
+	case q.Get("upload_id") != "":
+		f.uploadChunk(w, r, q.Get("upload_id"))
+	case q.Get("uploadType") == "resumable":
+		meta := &fakeObject{}
+		if err := decodeFakeObject(r.Body, meta); err != nil {
+			writeFakeError(w, http.StatusBadRequest, "invalid metadata: %v", err)
+			return
+		}
+		if meta.name == "" {
+			meta.name = q.Get("name")
+		}
+		meta.setEncryption(r)
+		f.nextID++
+		id := strconv.Itoa(f.nextID)
+		f.sessions[id] = &fakeUploadSession{bucket: b.name, object: meta, conds: q}
+		w.Header().Set("Location", fmt.Sprintf("%v/upload/storage/v1/b/%v/o?uploadType=resumable&upload_id=%v",
+			f.server.URL, url.PathEscape(b.name), id))
+		w.WriteHeader(http.StatusOK)
+	case q.Get("uploadType") == "multipart":
+		f.uploadMultipart(w, r, b)
+	default:
+		writeFakeError(w, http.StatusNotImplemented, "upload type %v not implemented", q.Get("uploadType"))
+	}
+}
+
+func (f *fakeStorage) uploadMultipart(w http.ResponseWriter, r *http.Request, b *fakeBucket) {
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		writeFakeError(w, http.StatusBadRequest, "invalid content type: %v", err)
+		return
+	}
+	mr := multipart.NewReader(r.Body, params["boundary"])
+
+	meta := &fakeObject{}
+	part, err := mr.NextPart()
+	if err == nil {
+		err = decodeFakeObject(part, meta)
+	}
+	if err != nil {
+		writeFakeError(w, http.StatusBadRequest, "invalid metadata: %v", err)
+		return
+	}
+
+	part, err = mr.NextPart()
+	if err != nil {
+		writeFakeError(w, http.StatusBadRequest, "missing media: %v", err)
+		return
+	}
+	if meta.contentType == "" {
+		meta.contentType = part.Header.Get("Content-Type")
+	}
+	meta.data, _ = io.ReadAll(part)
+	if meta.name == "" {
+		meta.name = r.URL.Query().Get("name")
+	}
+	meta.setEncryption(r)
+
+	o, code, err := f.finalize(b, meta, r.URL.Query())
+	if err != nil {
+		writeFakeError(w, code, "%v", err)
+		return
+	}
+	writeFakeJSON(w, o.resource())
+}
+
+func (f *fakeStorage) uploadChunk(w http.ResponseWriter, r *http.Request, id string) {
+	s, ok := f.sessions[id]
+	if !ok {
+		writeFakeError(w, http.StatusNotFound, "upload session %v not found", id)
+		return
+	}
+
+	// Content-Range is "bytes a-b/total", "bytes a-b/*", "bytes */total" or "bytes */*"
+	cr := strings.TrimPrefix(r.Header.Get("Content-Range"), "bytes ")
+	slash := strings.LastIndex(cr, "/")
+	if slash < 0 {
+		writeFakeError(w, http.StatusBadRequest, "invalid Content-Range %q", r.Header.Get("Content-Range"))
+		return
+	}
+	rng, totalText := cr[:slash], cr[slash+1:]
+
+	data, _ := io.ReadAll(r.Body)
+	if rng != "*" {
+		start, err := strconv.ParseInt(strings.SplitN(rng, "-", 2)[0], 10, 64)
+		if err != nil || start > int64(len(s.data)) {
+			writeFakeError(w, http.StatusBadRequest, "invalid Content-Range %q", r.Header.Get("Content-Range"))
+			return
+		}
+		// Only the bytes not already persisted are appended
+		skip := int64(len(s.data)) - start
+		if skip < int64(len(data)) {
+			s.data = append(s.data, data[skip:]...)
+		}
+	}
+
+	total := int64(-1)
+	if totalText != "*" {
+		total, _ = strconv.ParseInt(totalText, 10, 64)
+	}
+	if total < 0 || int64(len(s.data)) < total {
+		if len(s.data) > 0 {
+			w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", len(s.data)-1))
+		}
+		w.WriteHeader(http.StatusPermanentRedirect)
+		return
+	}
+
+	meta := *s.object
+	meta.data = s.data
+	o, code, err := f.finalize(f.buckets[s.bucket], &meta, s.conds)
+	if err != nil {
+		writeFakeError(w, code, "%v", err)
+		return
+	}
+	delete(f.sessions, id)
+	writeFakeJSON(w, o.resource())
+}
+
+// finalize stores a new generation of the object after checking the preconditions
+func (f *fakeStorage) finalize(b *fakeBucket, o *fakeObject, conds url.Values) (*fakeObject, int, error) {
+	current := b.objects[o.name]
+	if v := conds.Get("ifGenerationMatch"); v != "" {
+		want, _ := strconv.ParseInt(v, 10, 64)
+		if (want == 0 && current != nil) || (want != 0 && (current == nil || current.generation != want)) {
+			return nil, http.StatusPreconditionFailed, fmt.Errorf("generation precondition failed for %v", o.name)
+		}
+	}
+	if v := conds.Get("ifMetagenerationMatch"); v != "" {
+		want, _ := strconv.ParseInt(v, 10, 64)
+		if current == nil || current.metageneration != want {
+			return nil, http.StatusPreconditionFailed, fmt.Errorf("metageneration precondition failed for %v", o.name)
+		}
+	}
+
+	if current != nil {
+		b.archive(current)
+	}
+
+	f.nextGen++
+	now := time.Now().UTC()
+	o.bucket = b.name
+	o.generation = f.nextGen
+	o.metageneration = 1
+	o.created = now
+	o.updated = now
+	if o.contentType == "" {
+		o.contentType = "application/octet-stream"
+	}
+	b.objects[o.name] = o
+	return o, http.StatusOK, nil
+}
+
+// decodeFakeObject reads the JSON object resource sent with an upload
+func decodeFakeObject(r io.Reader, o *fakeObject) error {
+	var raw struct {
+		Name        string            `json:"name"`
+		ContentType string            `json:"contentType"`
+		Metadata    map[string]string `json:"metadata"`
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &raw); err != nil {
+			return err
+		}
+	}
+	o.name = raw.Name
+	o.contentType = raw.ContentType
+	o.metadata = raw.Metadata
+	return nil
+}
+
+// versioned reports whether the bucket keeps noncurrent generations
+func (b *fakeBucket) versioned() bool {
+	versioning, _ := b.fields["versioning"].(map[string]interface{})
+	return versioning["enabled"] == true
+}
+
+// find returns the live object when generation is empty and the given generation otherwise
+func (b *fakeBucket) find(name string, generation string) *fakeObject {
+	o := b.objects[name]
+	if generation == "" {
+		return o
+	}
+	if o != nil && strconv.FormatInt(o.generation, 10) == generation {
+		return o
+	}
+	for _, o := range b.noncurrent[name] {
+		if strconv.FormatInt(o.generation, 10) == generation {
+			return o
+		}
+	}
+	return nil
+}
+
+// archive keeps the generation as noncurrent when the bucket is versioned
+func (b *fakeBucket) archive(o *fakeObject) {
+	if b.versioned() {
+		o.deleted = time.Now().UTC()
+		b.noncurrent[o.name] = append(b.noncurrent[o.name], o)
+	}
+}
+
+// remove deletes a generation. The live one is archived unless the deletion is permanent,
+// which is the case when the generation was given explicitly.
+func (b *fakeBucket) remove(o *fakeObject, permanent bool) {
+	if b.objects[o.name] == o {
+		delete(b.objects, o.name)
+		if !permanent {
+			b.archive(o)
+		}
+		return
+	}
+	versions := b.noncurrent[o.name]
+	for i, v := range versions {
+		if v == o {
+			b.noncurrent[o.name] = append(versions[:i:i], versions[i+1:]...)
+		}
+	}
+	if len(b.noncurrent[o.name]) == 0 {
+		delete(b.noncurrent, o.name)
+	}
+}
+
+// setEncryption records the key a write request encrypts the object with
+func (o *fakeObject) setEncryption(r *http.Request) {
+	q := r.URL.Query()
+	o.keySHA256 = r.Header.Get("X-Goog-Encryption-Key-Sha256")
+	if name := q.Get("kmsKeyName"); name != "" {
+		o.kmsKeyName = name
+	}
+	if name := q.Get("destinationKmsKeyName"); name != "" {
+		o.kmsKeyName = name
+	}
+}
+
+// fakeKeyReason returns the reason GCS gives for a read of the object content with a
+// missing or wrong customer-supplied key, empty when the key is right
+func fakeKeyReason(o *fakeObject, keySHA256 string) string {
+	switch {
+	case o.keySHA256 == "" && keySHA256 != "":
+		return "resourceNotEncryptedWithCustomerEncryptionKey"
+	case o.keySHA256 != "" && keySHA256 == "":
+		return "resourceIsEncryptedWithCustomerEncryptionKey"
+	case o.keySHA256 != keySHA256:
+		return "customerEncryptionKeyIsIncorrect"
+	}
+	return ""
+}
+
+// checkFakeKey fails a JSON API read when the customer-supplied key is missing or wrong
+func checkFakeKey(w http.ResponseWriter, o *fakeObject, keySHA256 string) bool {
+	reason := fakeKeyReason(o, keySHA256)
+	if reason != "" {
+		writeFakeReason(w, http.StatusBadRequest, reason, "customer-supplied encryption key check failed for %v", o.name)
+	}
+	return reason == ""
+}
+
+func (o *fakeObject) md5() string {
+	sum := md5.Sum(o.data)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func (o *fakeObject) crc32c() string {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], crc32.Checksum(o.data, crc32.MakeTable(crc32.Castagnoli)))
+	return base64.StdEncoding.EncodeToString(b[:])
+}
+
+func (o *fakeObject) resource() map[string]interface{} {
+	res := map[string]interface{}{
+		"kind":           "storage#object",
+		"bucket":         o.bucket,
+		"name":           o.name,
+		"size":           strconv.Itoa(len(o.data)),
+		"contentType":    o.contentType,
+		"metadata":       o.metadata,
+		"generation":     strconv.FormatInt(o.generation, 10),
+		"metageneration": strconv.FormatInt(o.metageneration, 10),
+		"md5Hash":        o.md5(),
+		"crc32c":         o.crc32c(),
+		"storageClass":   "STANDARD",
+		"owner":          map[string]string{"entity": "project-owners-test-project"},
+		"timeCreated":    o.created.Format(time.RFC3339Nano),
+		"updated":        o.updated.Format(time.RFC3339Nano),
+	}
+	if !o.deleted.IsZero() {
+		res["timeDeleted"] = o.deleted.Format(time.RFC3339Nano)
+	}
+	if o.keySHA256 != "" {
+		res["customerEncryption"] = map[string]string{"encryptionAlgorithm": "AES256", "keySha256": o.keySHA256}
+	}
+	if o.kmsKeyName != "" {
+		res["kmsKeyName"] = o.kmsKeyName
+	}
+	return res
+}
+
+func (f *fakeStorage) insertBucket(w http.ResponseWriter, r *http.Request) {
+	var fields map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&fields); err != nil {
+		writeFakeError(w, http.StatusBadRequest, "invalid bucket: %v", err)
+		return
+	}
+	name, _ := fields["name"].(string)
+	if _, ok := f.buckets[name]; ok {
+		writeFakeError(w, http.StatusConflict, "bucket %v already exists", name)
+		return
+	}
+	delete(fields, "name")
+
+	b := newFakeBucket(name)
+	b.set(fields)
+	f.buckets[name] = b
+	writeFakeJSON(w, b.resource())
+}
+
+// listBuckets returns every bucket in a single page, the project is not checked
+func (f *fakeStorage) listBuckets(w http.ResponseWriter) {
+	names := make([]string, 0, len(f.buckets))
+	for name := range f.buckets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	items := make([]map[string]interface{}, 0, len(names))
+	for _, name := range names {
+		items = append(items, f.buckets[name].resource())
+	}
+	writeFakeJSON(w, map[string]interface{}{
+		"kind":  "storage#buckets",
+		"items": items,
+	})
+}
+
+func (f *fakeStorage) patchBucket(w http.ResponseWriter, r *http.Request, b *fakeBucket) {
+	if f.patchBucketError != 0 {
+		writeFakeError(w, f.patchBucketError, "injected bucket patch failure")
+		return
+	}
+	if m := r.URL.Query().Get("ifMetagenerationMatch"); m != "" && m != strconv.FormatInt(b.metageneration, 10) {
+		writeFakeError(w, http.StatusPreconditionFailed, "metageneration %v does not match", m)
+		return
+	}
+	var patch map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+		writeFakeError(w, http.StatusBadRequest, "invalid bucket: %v", err)
+		return
+	}
+	b.set(patch)
+	b.metageneration++
+	writeFakeJSON(w, b.resource())
+}
+
+// set stores the fields of the resource, null fields are removed
+func (b *fakeBucket) set(fields map[string]interface{}) {
+	for k, v := range fields {
+		if v == nil {
+			delete(b.fields, k)
+			continue
+		}
+		if policy, ok := v.(map[string]interface{}); ok && k == "retentionPolicy" {
+			policy["effectiveTime"] = time.Now().UTC().Format(time.RFC3339)
+		}
+		b.fields[k] = v
+	}
+}
+
+func (b *fakeBucket) policy() *raw.Policy {
+	return &raw.Policy{
+		Kind:            "storage#policy",
+		Etag:            base64.StdEncoding.EncodeToString([]byte(strconv.Itoa(b.policyWrites))),
+		Version:         3,
+		Bindings:        b.bindings,
+		ForceSendFields: []string{"Bindings"},
+	}
+}
+
+// failPolicyReads makes IAM policy reads of the bucket fail with the status
+func (f *fakeStorage) failPolicyReads(bucket string, status int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.policyReadErrors == nil {
+		f.policyReadErrors = make(map[string]int)
+	}
+	f.policyReadErrors[bucket] = status
+}
+
+// getPolicy returns the IAM policy, version 1 reads fail once it has conditional bindings
+func (f *fakeStorage) getPolicy(w http.ResponseWriter, r *http.Request, b *fakeBucket) {
+	if status := f.policyReadErrors[b.name]; status != 0 {
+		writeFakeError(w, status, "no permission to read the policy of %v", b.name)
+		return
+	}
+	version, _ := strconv.Atoi(r.URL.Query().Get("optionsRequestedPolicyVersion"))
+	for _, binding := range b.bindings {
+		if binding.Condition != nil && version < 3 {
+			writeFakeError(w, http.StatusBadRequest, "policy has conditional bindings, request version 3")
+			return
+		}
+	}
+	writeFakeJSON(w, b.policy())
+}
+
+// setPolicy replaces the IAM policy, rejecting writes based on an older etag
+func (f *fakeStorage) setPolicy(w http.ResponseWriter, r *http.Request, b *fakeBucket) {
+	policy := &raw.Policy{}
+	if err := json.NewDecoder(r.Body).Decode(policy); err != nil {
+		writeFakeError(w, http.StatusBadRequest, "invalid policy: %v", err)
+		return
+	}
+	if f.staleIAMWrites > 0 {
+		f.staleIAMWrites--
+		b.policyWrites++
+	}
+	if policy.Etag != "" && policy.Etag != b.policy().Etag {
+		writeFakeError(w, http.StatusPreconditionFailed, "policy etag does not match")
+		return
+	}
+	for _, binding := range policy.Bindings {
+		if binding.Condition != nil && policy.Version < 3 {
+			writeFakeError(w, http.StatusBadRequest, "conditional bindings need policy version 3")
+			return
+		}
+	}
+	b.bindings = policy.Bindings
+	b.policyWrites++
+	writeFakeJSON(w, b.policy())
+}
+
+func (b *fakeBucket) resource() map[string]interface{} {
+	res := map[string]interface{}{
+		"kind":           "storage#bucket",
+		"name":           b.name,
+		"location":       "US",
+		"locationType":   "multi-region",
+		"storageClass":   "STANDARD",
+		"metageneration": strconv.FormatInt(b.metageneration, 10),
+		"timeCreated":    b.created.Format(time.RFC3339Nano),
+	}
+	for k, v := range b.fields {
+		res[k] = v
+	}
+	return res
+}
@@ -2,6 +2,7 @@ package cloudygcp
 
 import (
 	"context"
+	"strings"
 
 	"github.com/appliedres/cloudy"
 )
@@ -12,6 +13,7 @@ func init() {
 }
 
 type SecretManagerEnvironmentConfig struct {
+	GcpCredentials
 	Project string
 	Prefix  string
 }
@@ -23,7 +25,7 @@ func (c *SecretManagerEnvironmentFactory) Create(cfg interface{}) (cloudy.Enviro
 	if sec == nil {
 		return nil, cloudy.ErrInvalidConfiguration
 	}
-	kve, err := NewSecretManagerEnvironmentService(context.Background(), sec.Project, sec.Prefix)
+	kve, err := NewSecretManagerEnvironmentService(context.Background(), sec.Project, sec.Prefix, sec.GcpCredentials)
 	return kve, err
 }
 
@@ -31,6 +33,7 @@ func (c *SecretManagerEnvironmentFactory) FromEnv(env *cloudy.Environment) (inte
 	cfg := &SecretManagerEnvironmentConfig{}
 	cfg.Project = env.Force("GCP_PROJECT")
 	cfg.Prefix = env.Get("prefix")
+	cfg.GcpCredentials = GetCredentialsFromEnv(env)
 
 	return cfg, nil
 }
@@ -42,7 +45,7 @@ func (c *SecretManagerEnvironmentCachedFactory) Create(cfg interface{}) (cloudy.
 	if sec == nil {
 		return nil, cloudy.ErrInvalidConfiguration
 	}
-	kve, err := NewSecretManagerEnvironmentService(context.Background(), sec.Project, sec.Prefix)
+	kve, err := NewSecretManagerEnvironmentService(context.Background(), sec.Project, sec.Prefix, sec.GcpCredentials)
 	if err != nil {
 		return nil, err
 	}
@@ -53,6 +56,7 @@ func (c *SecretManagerEnvironmentCachedFactory) FromEnv(env *cloudy.Environment)
 	cfg := &SecretManagerEnvironmentConfig{}
 	cfg.Project = env.Force("GCP_PROJECT")
 	cfg.Prefix = env.Get("prefix")
+	cfg.GcpCredentials = GetCredentialsFromEnv(env)
 
 	return cfg, nil
 }
@@ -62,8 +66,8 @@ type SecretManagerEnvironment struct {
 	Prefix string
 }
 
-func NewSecretManagerEnvironmentService(ctx context.Context, project string, prefix string) (*SecretManagerEnvironment, error) {
-	sm, err := NewSecretManager(ctx, project, GcpCredentials{})
+func NewSecretManagerEnvironmentService(ctx context.Context, project string, prefix string, credentials GcpCredentials) (*SecretManagerEnvironment, error) {
+	sm, err := NewSecretManager(ctx, project, credentials)
 	env := &SecretManagerEnvironment{
 		Vault:  sm,
 		Prefix: prefix,
@@ -75,10 +79,27 @@ func LoadEnvironment(ctx context.Context) (*cloudy.Environment, error) {
 	return nil, nil
 }
 
+// SecretKey translates an environment name to the key of its secret: the name is
+// normalized with cloudy.NormalizeEnvName and the prefix is prepended as is, so with the
+// prefix "staging_" the name "db.url" is stored in the secret "staging_DB_URL". Include a
+// separator in the prefix to keep the environments apart.
+func (kve *SecretManagerEnvironment) SecretKey(name string) string {
+	return kve.Prefix + cloudy.NormalizeEnvName(name)
+}
+
+// envName returns the environment name stored in the secret, false when the secret is
+// not part of the environment
+func (kve *SecretManagerEnvironment) envName(key string) (string, bool) {
+	if !strings.HasPrefix(key, kve.Prefix) || len(key) == len(kve.Prefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(key, kve.Prefix), true
+}
+
 func (kve *SecretManagerEnvironment) Get(name string) (string, error) {
 	ctx := cloudy.StartContext()
 
-	val, err := kve.Vault.GetSecret(ctx, name)
+	val, err := kve.Vault.GetSecret(ctx, kve.SecretKey(name))
 	if err != nil {
 		return "", err
 	}
@@ -90,11 +111,55 @@ func (kve *SecretManagerEnvironment) Get(name string) (string, error) {
 
 func (kve *SecretManagerEnvironment) SaveAll(ctx context.Context, items map[string]string) error {
 	for k, v := range items {
-		name := cloudy.NormalizeEnvName(k)
-		err := kve.Vault.SaveSecret(ctx, name, v)
+		err := kve.Vault.SaveSecret(ctx, kve.SecretKey(k), v)
 		if err != nil {
 			return err
 		}
 	}
 	return nil
 }
+
+// Names lists the normalized names of the environment, the secrets under its prefix
+func (kve *SecretManagerEnvironment) Names(ctx context.Context) ([]string, error) {
+	names := []string{}
+	err := kve.Vault.ListSecretsEach(ctx, &ListSecretsOptions{Prefix: kve.Prefix}, func(secret *SecretInfo) error {
+		if name, ok := kve.envName(secret.Key); ok && !secret.Hashed {
+			names = append(names, name)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return names, nil
+}
+
+// LoadAll reads every secret under the prefix of the environment in one pass, keyed by
+// the normalized name. Secrets that have no readable value are left out.
+func (kve *SecretManagerEnvironment) LoadAll(ctx context.Context) (map[string]string, error) {
+	items := make(map[string]string)
+	err := kve.Vault.ListSecretsEach(ctx, &ListSecretsOptions{Prefix: kve.Prefix}, func(secret *SecretInfo) error {
+		name, ok := kve.envName(secret.Key)
+		if !ok || secret.Hashed {
+			return nil
+		}
+		val, err := kve.Vault.GetSecret(ctx, secret.Key)
+		// The latest version is disabled or destroyed, the other secrets are still loaded
+		if IsPreconditionFailed(err) {
+			cloudy.Warn(ctx, "LoadAll: skipping %v, its latest version is not enabled", secret.Key)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		// Secrets without any version read as empty
+		if val != "" {
+			items[name] = val
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return items, nil
+}
@@ -0,0 +1,56 @@
+package cloudygcp
+
+import (
+	"testing"
+
+	"github.com/appliedres/cloudy"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSecretManagerEnvironmentPrefix(t *testing.T) {
+	ctx := cloudy.StartContext()
+	fake, sm := startFakeSecretManager(t, "test-project")
+	staging := &SecretManagerEnvironment{Vault: sm, Prefix: "staging_"}
+	prod := &SecretManagerEnvironment{Vault: sm, Prefix: "prod_"}
+
+	assert.Equal(t, "staging_DB_URL", staging.SecretKey("db.url"))
+
+	assert.Nil(t, staging.SaveAll(ctx, map[string]string{"db.url": "postgres://staging", "api-key": "one"}))
+	assert.Nil(t, prod.SaveAll(ctx, map[string]string{"db.url": "postgres://prod"}))
+	assert.Contains(t, fake.secrets, "projects/test-project/secrets/staging_DB_URL")
+	assert.Contains(t, fake.secrets, "projects/test-project/secrets/prod_DB_URL")
+
+	// Reads use the same translation as saves
+	val, err := staging.Get("db.url")
+	assert.Nil(t, err)
+	assert.Equal(t, "postgres://staging", val)
+	val, err = prod.Get("DB_URL")
+	assert.Nil(t, err)
+	assert.Equal(t, "postgres://prod", val)
+
+	_, err = prod.Get("api-key")
+	assert.ErrorIs(t, err, cloudy.ErrKeyNotFound)
+
+	names, err := staging.Names(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"API_KEY", "DB_URL"}, names)
+
+	items, err := prod.LoadAll(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"DB_URL": "postgres://prod"}, items)
+}
+
+func TestSecretManagerEnvironmentNoPrefix(t *testing.T) {
+	ctx := cloudy.StartContext()
+	_, sm := startFakeSecretManager(t, "test-project")
+	env := &SecretManagerEnvironment{Vault: sm}
+
+	assert.Nil(t, env.SaveAll(ctx, map[string]string{"db.url": "postgres://local"}))
+	val, err := env.Get("db.url")
+	assert.Nil(t, err)
+	assert.Equal(t, "postgres://local", val)
+
+	val, err = sm.GetSecret(ctx, "DB_URL")
+	assert.Nil(t, err)
+	assert.Equal(t, "postgres://local", val)
+}
@@ -0,0 +1,160 @@
+package cloudygcp
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/secretmanager/apiv1/secretmanagerpb"
+	"google.golang.org/api/iterator"
+)
+
+// DefaultSecretPageSize is the page size of ListSecretsPage when none is given
+const DefaultSecretPageSize = 100
+
+// ListSecretsOptions controls the secret listing functions. All the filters are combined.
+type ListSecretsOptions struct {
+	// Only list secrets whose key starts with the prefix
+	Prefix string
+	// Only list secrets that have all of these labels
+	Labels map[string]string
+	// Only list secrets created after (or before) the time, ignored when zero
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+
+	// Number of secrets per page for ListSecretsPage, defaults to DefaultSecretPageSize
+	PageSize int
+	// Token returned by the previous page, empty for the first page
+	PageToken string
+}
+
+// SecretInfo describes a secret, without its value
+type SecretInfo struct {
+	// Key decoded from the secret ID, see EncodeSecretID
+	Key string
+	// ID of the secret in Secret Manager
+	ID string
+	// The key was too long and was hashed, Key only holds its start
+	Hashed  bool
+	Labels  map[string]string
+	Created time.Time
+}
+
+// SecretPage is a single page of a secret listing
+type SecretPage struct {
+	Secrets []*SecretInfo
+	// Token of the next page, empty when this is the last page
+	NextPageToken string
+}
+
+// filter builds the Secret Manager list filter. The name filter matches anywhere in the
+// name, so it finds both the plain and the encoded IDs. The prefix itself is checked on
+// the decoded keys.
+func (opts *ListSecretsOptions) filter() string {
+	var terms []string
+	if prefix := secretIDPrefix(opts.Prefix); prefix != "" {
+		terms = append(terms, "name:"+prefix)
+	}
+	labels := make([]string, 0, len(opts.Labels))
+	for k := range opts.Labels {
+		labels = append(labels, k)
+	}
+	sort.Strings(labels)
+	for _, k := range labels {
+		terms = append(terms, fmt.Sprintf("labels.%v=%v", k, opts.Labels[k]))
+	}
+	if !opts.CreatedAfter.IsZero() {
+		terms = append(terms, "create_time>"+opts.CreatedAfter.UTC().Format(time.RFC3339))
+	}
+	if !opts.CreatedBefore.IsZero() {
+		terms = append(terms, "create_time<"+opts.CreatedBefore.UTC().Format(time.RFC3339))
+	}
+	return strings.Join(terms, " AND ")
+}
+
+func (k *SecretManager) listRequest(opts *ListSecretsOptions) *secretmanagerpb.ListSecretsRequest {
+	return &secretmanagerpb.ListSecretsRequest{
+		Parent: "projects/" + k.Project,
+		Filter: opts.filter(),
+	}
+}
+
+// toSecretInfo converts a listed secret, returning nil when it does not match the prefix
+func toSecretInfo(s *secretmanagerpb.Secret, opts *ListSecretsOptions) *SecretInfo {
+	id := s.Name[strings.LastIndex(s.Name, "/")+1:]
+	key, complete := DecodeSecretID(id)
+	if !strings.HasPrefix(key, opts.Prefix) {
+		return nil
+	}
+	info := &SecretInfo{Key: key, ID: id, Hashed: !complete, Labels: s.Labels}
+	if s.CreateTime != nil {
+		info.Created = s.CreateTime.AsTime()
+	}
+	return info
+}
+
+// ListSecretsEach calls fn for each secret of the project matching the options, reading
+// as many pages as needed. Listing stops at the first error returned by fn.
+func (k *SecretManager) ListSecretsEach(ctx context.Context, opts *ListSecretsOptions, fn func(secret *SecretInfo) error) error {
+	if opts == nil {
+		opts = &ListSecretsOptions{}
+	}
+	it := k.Client.ListSecrets(ctx, k.listRequest(opts))
+	for {
+		s, err := it.Next()
+		if err == iterator.Done {
+			return nil
+		}
+		if err != nil {
+			return classifyGrpcError(err)
+		}
+		if info := toSecretInfo(s, opts); info != nil {
+			if err = fn(info); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// ListSecrets returns the keys of every secret matching the options. Hashed keys are
+// skipped as they cannot be read back, use ListSecretsEach to see them.
+func (k *SecretManager) ListSecrets(ctx context.Context, opts *ListSecretsOptions) ([]string, error) {
+	keys := []string{}
+	err := k.ListSecretsEach(ctx, opts, func(secret *SecretInfo) error {
+		if !secret.Hashed {
+			keys = append(keys, secret.Key)
+		}
+		return nil
+	})
+	return keys, err
+}
+
+// ListSecretsPage returns a single page of secrets. Pass the NextPageToken of the result as
+// the PageToken of the options to read the following page. Pages can be shorter than the
+// page size when a prefix is given.
+func (k *SecretManager) ListSecretsPage(ctx context.Context, opts *ListSecretsOptions) (*SecretPage, error) {
+	if opts == nil {
+		opts = &ListSecretsOptions{}
+	}
+	pageSize := opts.PageSize
+	if pageSize <= 0 {
+		pageSize = DefaultSecretPageSize
+	}
+	it := k.Client.ListSecrets(ctx, k.listRequest(opts))
+
+	var secrets []*secretmanagerpb.Secret
+	next, err := iterator.NewPager(it, pageSize, opts.PageToken).NextPage(&secrets)
+	if err != nil {
+		return nil, classifyGrpcError(err)
+	}
+
+	page := &SecretPage{Secrets: []*SecretInfo{}, NextPageToken: next}
+	for _, s := range secrets {
+		if info := toSecretInfo(s, opts); info != nil {
+			page.Secrets = append(page.Secrets, info)
+		}
+	}
+	return page, nil
+}
@@ -0,0 +1,113 @@
+package cloudygcp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/appliedres/cloudy"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestListSecrets(t *testing.T) {
+	ctx := cloudy.StartContext()
+	fake, sm := startFakeSecretManager(t, "test-project")
+
+	for _, key := range []string{"prod-db", "prod-api", "dev-db", "dev-api", "shared-prod-token"} {
+		assert.Nil(t, sm.SaveSecret(ctx, key, "value-"+key))
+	}
+	created := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	fake.secrets["projects/test-project/secrets/prod-db"].secret.CreateTime = timestamppb.New(created)
+	fake.secrets["projects/test-project/secrets/prod-db"].secret.Labels = map[string]string{"team": "payments"}
+	fake.secrets["projects/test-project/secrets/dev-db"].secret.Labels = map[string]string{"team": "payments"}
+
+	keys, err := sm.ListSecrets(ctx, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"dev-api", "dev-db", "prod-api", "prod-db", "shared-prod-token"}, keys)
+
+	// The prefix must match the start of the key
+	keys, err = sm.ListSecrets(ctx, &ListSecretsOptions{Prefix: "prod-"})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"prod-api", "prod-db"}, keys)
+
+	keys, err = sm.ListSecrets(ctx, &ListSecretsOptions{Labels: map[string]string{"team": "payments"}})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"dev-db", "prod-db"}, keys)
+
+	keys, err = sm.ListSecrets(ctx, &ListSecretsOptions{Prefix: "prod-", CreatedAfter: created.Add(time.Hour)})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"prod-api"}, keys)
+
+	var infos []*SecretInfo
+	err = sm.ListSecretsEach(ctx, &ListSecretsOptions{CreatedBefore: created.Add(time.Hour)}, func(secret *SecretInfo) error {
+		infos = append(infos, secret)
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Len(t, infos, 1)
+	assert.Equal(t, "prod-db", infos[0].Key)
+	assert.Equal(t, created, infos[0].Created)
+	assert.Equal(t, "payments", infos[0].Labels["team"])
+}
+
+func TestListSecretsPage(t *testing.T) {
+	ctx := cloudy.StartContext()
+	_, sm := startFakeSecretManager(t, "test-project")
+
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		assert.Nil(t, sm.SaveSecret(ctx, key, key))
+	}
+
+	var keys []string
+	opts := &ListSecretsOptions{PageSize: 2}
+	pages := 0
+	for {
+		page, err := sm.ListSecretsPage(ctx, opts)
+		if !assert.Nil(t, err) {
+			return
+		}
+		pages++
+		for _, s := range page.Secrets {
+			keys = append(keys, s.Key)
+		}
+		if page.NextPageToken == "" {
+			break
+		}
+		opts.PageToken = page.NextPageToken
+	}
+	assert.Equal(t, 3, pages)
+	assert.Equal(t, []string{"a", "b", "c", "d", "e"}, keys)
+}
+
+func TestSecretManagerEnvironmentLoadAll(t *testing.T) {
+	ctx := cloudy.StartContext()
+	fake, sm := startFakeSecretManager(t, "test-project")
+	env := &SecretManagerEnvironment{Vault: sm, Prefix: "staging-"}
+
+	assert.Nil(t, sm.SaveSecret(ctx, "staging-DB_URL", "postgres://staging"))
+	assert.Nil(t, sm.SaveSecret(ctx, "staging-API_KEY", "key"))
+	assert.Nil(t, sm.SaveSecret(ctx, "prod-DB_URL", "postgres://prod"))
+
+	items, err := env.LoadAll(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"DB_URL": "postgres://staging", "API_KEY": "key"}, items)
+	assert.Equal(t, 1, fake.listRequests)
+}
+
+func TestSecretManagerEnvironmentLoadAllDisabled(t *testing.T) {
+	ctx := cloudy.StartContext()
+	_, sm := startFakeSecretManager(t, "test-project")
+	env := &SecretManagerEnvironment{Vault: sm, Prefix: "dev_"}
+
+	assert.Nil(t, env.SaveAll(ctx, map[string]string{"db.url": "postgres://dev", "api-key": "one"}))
+	assert.Nil(t, env.SaveAll(ctx, map[string]string{"api-key": "two"}))
+
+	// A disabled latest version does not stop the other secrets from loading
+	assert.Nil(t, sm.DisableSecretVersion(ctx, env.SecretKey("api-key"), "2"))
+	_, err := env.Get("api-key")
+	assert.True(t, IsPreconditionFailed(err))
+
+	items, err := env.LoadAll(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"DB_URL": "postgres://dev"}, items)
+}
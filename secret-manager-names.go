@@ -0,0 +1,146 @@
+package cloudygcp
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+)
+
+// MaxSecretIDLength is the longest secret ID Secret Manager accepts
+const MaxSecretIDLength = 255
+
+const (
+	// secretEncodedMarker starts the IDs of keys that are not valid IDs themselves
+	secretEncodedMarker = "__-"
+	// secretHashMarker replaces the end of keys that are too long, followed by a hash of
+	// the whole key. 'z' is not a hex digit so the marker cannot be read as an escape.
+	secretHashMarker = "-z"
+	// secretHashLength is the number of hex digits of the hash of long keys
+	secretHashLength = 32
+)
+
+// errEmptySecretKey is returned for the empty key, which has no secret ID
+var errEmptySecretKey = errors.New("the secret key is empty")
+
+// EncodeSecretID maps a cloudy key onto the secret ID alphabet [A-Za-z0-9_-]. Keys that
+// are valid IDs, which includes every secret created before keys were encoded, are kept
+// as they are unless they start with "__-". Other keys start with "__-":
+//
+//   - letters, digits and "_" are kept
+//   - every other byte becomes "-" and its two lowercase hex digits, "." is "-2e"
+//
+// So "app/db.url" is stored as "__-app-2fdb-2eurl" and "__-2f" as "__-__-2d2f", every
+// key has its own ID. The encoding is reversed by DecodeSecretID. When the result is
+// longer than MaxSecretIDLength it is cut and ends with "-z" and a hash of the key
+// instead. Such IDs are still unique but the end of the key cannot be recovered. The
+// empty key is an error.
+func EncodeSecretID(key string) (string, error) {
+	if key == "" {
+		return "", errEmptySecretKey
+	}
+	if isSecretID(key) && !strings.HasPrefix(key, secretEncodedMarker) {
+		return key, nil
+	}
+
+	var id strings.Builder
+	id.WriteString(secretEncodedMarker)
+	// Length of id at the end of each byte of the key, to cut it between escapes
+	ends := make([]int, 0, len(key))
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		if isSecretIDChar(c) && c != '-' {
+			id.WriteByte(c)
+		} else {
+			id.WriteByte('-')
+			id.WriteString(hex.EncodeToString([]byte{c}))
+		}
+		ends = append(ends, id.Len())
+	}
+	if id.Len() <= MaxSecretIDLength {
+		return id.String(), nil
+	}
+
+	keep := len(secretEncodedMarker)
+	for _, end := range ends {
+		if end > MaxSecretIDLength-len(secretHashMarker)-secretHashLength {
+			break
+		}
+		keep = end
+	}
+	sum := sha256.Sum256([]byte(key))
+	return id.String()[:keep] + secretHashMarker + hex.EncodeToString(sum[:])[:secretHashLength], nil
+}
+
+// DecodeSecretID returns the key of the secret ID. For IDs of keys that were too long it
+// returns the start of the key that was kept and false. IDs without the "__-" marker,
+// including every ID created before keys were encoded, are the key. IDs with the marker
+// that EncodeSecretID does not create are returned as they are, no key maps to them.
+func DecodeSecretID(id string) (string, bool) {
+	body := strings.TrimPrefix(id, secretEncodedMarker)
+	if body == id {
+		return id, true
+	}
+
+	var key strings.Builder
+	for i := 0; i < len(body); i++ {
+		c := body[i]
+		if c != '-' {
+			key.WriteByte(c)
+			continue
+		}
+		if rest := body[i+1:]; strings.HasPrefix(rest, "z") && len(rest) == 1+secretHashLength && isHex(rest[1:]) {
+			return key.String(), false
+		}
+		if i+3 > len(body) || !isHex(body[i+1:i+3]) {
+			return id, true
+		}
+		b, _ := hex.DecodeString(body[i+1 : i+3])
+		key.Write(b)
+		i += 2
+	}
+
+	// Only IDs that EncodeSecretID creates are decoded, others are kept as they are
+	decoded := key.String()
+	if encoded, err := EncodeSecretID(decoded); err != nil || encoded != id {
+		return id, true
+	}
+	return decoded, true
+}
+
+// secretIDPrefix returns the start of the key that appears unchanged in the ID of every
+// key starting with it, whether the key is encoded or not
+func secretIDPrefix(prefix string) string {
+	for i := 0; i < len(prefix); i++ {
+		if !isSecretIDChar(prefix[i]) || prefix[i] == '-' {
+			return prefix[:i]
+		}
+	}
+	return prefix
+}
+
+// isSecretID reports whether the key can be used as a secret ID as it is
+func isSecretID(key string) bool {
+	if len(key) == 0 || len(key) > MaxSecretIDLength {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		if !isSecretIDChar(key[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func isSecretIDChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-'
+}
+
+func isHex(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if !(s[i] >= '0' && s[i] <= '9' || s[i] >= 'a' && s[i] <= 'f') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,193 @@
+package cloudygcp
+
+import (
+	"math/rand"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"testing/quick"
+
+	"github.com/appliedres/cloudy"
+	"github.com/stretchr/testify/assert"
+)
+
+var secretIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,255}$`)
+
+// secretKey generates keys biased towards the characters that need escaping
+type secretKey string
+
+func (secretKey) Generate(r *rand.Rand, size int) reflect.Value {
+	alphabet := []string{"a", "Z", "0", "_", "-", "_-", ".", "/", ":", " ", "é", "\x00", "\xff", "-2e", "-z", "__-"}
+	n := r.Intn(size*4) + 1
+	var b strings.Builder
+	for i := 0; i < n; i++ {
+		b.WriteString(alphabet[r.Intn(len(alphabet))])
+	}
+	return reflect.ValueOf(secretKey(b.String()))
+}
+
+var quickConfig = &quick.Config{MaxCount: 2000}
+
+// encodeSecretID encodes keys known to be valid
+func encodeSecretID(t *testing.T, key string) string {
+	id, err := EncodeSecretID(key)
+	assert.Nil(t, err)
+	return id
+}
+
+func TestSecretIDRoundTrip(t *testing.T) {
+	roundTrip := func(key secretKey) bool {
+		id, err := EncodeSecretID(string(key))
+		if err != nil || !secretIDPattern.MatchString(id) {
+			return false
+		}
+		decoded, complete := DecodeSecretID(id)
+		if complete {
+			return decoded == string(key)
+		}
+		// Long keys keep their start
+		return strings.HasPrefix(id, secretEncodedMarker) && strings.HasPrefix(string(key), decoded)
+	}
+	assert.Nil(t, quick.Check(roundTrip, quickConfig))
+}
+
+func TestSecretIDUnique(t *testing.T) {
+	unique := func(a secretKey, b secretKey) bool {
+		idA, _ := EncodeSecretID(string(a))
+		idB, _ := EncodeSecretID(string(b))
+		return a == b || idA != idB
+	}
+	assert.Nil(t, quick.Check(unique, quickConfig))
+
+	// Keys that only differ after the part kept for long keys
+	long := strings.Repeat("k", 300)
+	assert.NotEqual(t, encodeSecretID(t, long+"a"), encodeSecretID(t, long+"b"))
+}
+
+func TestSecretIDValidKept(t *testing.T) {
+	valid := func(key secretKey) bool {
+		k := string(key)
+		if !secretIDPattern.MatchString(k) || strings.HasPrefix(k, secretEncodedMarker) {
+			return true
+		}
+		id, err := EncodeSecretID(k)
+		return err == nil && id == k
+	}
+	assert.Nil(t, quick.Check(valid, quickConfig))
+}
+
+func TestSecretIDExamples(t *testing.T) {
+	for key, id := range map[string]string{
+		"DB_URL":            "DB_URL",
+		"prod-db":           "prod-db",
+		"my_-secret":        "my_-secret",
+		"legacy_-ab":        "legacy_-ab",
+		"_":                 "_",
+		"staging_API_KEY-2": "staging_API_KEY-2",
+		"app.db/url":        "__-app-2edb-2furl",
+		"tenant:42":         "__-tenant-3a42",
+		"naïve":             "__-na-c3-afve",
+		"a-b/c":             "__-a-2db-2fc",
+		"__-2f":             "__-__-2d2f",
+		"__--2f":            "__-__-2d-2d2f",
+		"__-a-2eb":          "__-__-2da-2d2eb",
+		"__-":               "__-__-2d",
+	} {
+		assert.Equal(t, id, encodeSecretID(t, key), key)
+		decoded, complete := DecodeSecretID(id)
+		assert.True(t, complete)
+		assert.Equal(t, key, decoded)
+	}
+
+	// Keys starting with the marker do not share the secret of the key they look like
+	assert.NotEqual(t, encodeSecretID(t, "/"), encodeSecretID(t, "__--2f"))
+	assert.NotEqual(t, encodeSecretID(t, "a.b"), encodeSecretID(t, "__-a-2eb"))
+
+	// IDs that were not created by encoding a key are the key
+	for _, id := range []string{"__-abc", "__-2F", "__-a-2d", "__-", "__-x-z"} {
+		decoded, complete := DecodeSecretID(id)
+		assert.True(t, complete)
+		assert.Equal(t, id, decoded)
+	}
+
+	_, err := EncodeSecretID("")
+	assert.NotNil(t, err)
+
+	long := strings.Repeat("/", 100)
+	id := encodeSecretID(t, long)
+	assert.LessOrEqual(t, len(id), MaxSecretIDLength)
+	assert.Contains(t, id, secretHashMarker)
+	decoded, complete := DecodeSecretID(id)
+	assert.False(t, complete)
+	assert.True(t, strings.HasPrefix(long, decoded))
+
+	// Valid keys that are too long are hashed as well
+	id = encodeSecretID(t, strings.Repeat("k", MaxSecretIDLength+1))
+	assert.LessOrEqual(t, len(id), MaxSecretIDLength)
+	_, complete = DecodeSecretID(id)
+	assert.False(t, complete)
+}
+
+func TestSecretManagerEncodedKeys(t *testing.T) {
+	ctx := cloudy.StartContext()
+	fake, sm := startFakeSecretManager(t, "test-project")
+
+	assert.Nil(t, sm.SaveSecret(ctx, "app/db.url", "postgres://"))
+	assert.Nil(t, sm.SaveSecret(ctx, "app/api:key", "secret"))
+	assert.Nil(t, sm.SaveSecret(ctx, "app_-other", "other"))
+	assert.Contains(t, fake.secrets, "projects/test-project/secrets/__-app-2fdb-2eurl")
+	assert.Contains(t, fake.secrets, "projects/test-project/secrets/app_-other")
+
+	val, err := sm.GetSecret(ctx, "app/db.url")
+	assert.Nil(t, err)
+	assert.Equal(t, "postgres://", val)
+
+	keys, err := sm.ListSecrets(ctx, &ListSecretsOptions{Prefix: "app/"})
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, []string{"app/db.url", "app/api:key"}, keys)
+
+	keys, err = sm.ListSecrets(ctx, &ListSecretsOptions{Prefix: "app_"})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"app_-other"}, keys)
+
+	// The empty key has no secret
+	assert.NotNil(t, sm.SaveSecret(ctx, "", "empty"))
+	_, err = sm.GetSecret(ctx, "")
+	assert.NotNil(t, err)
+
+	// Long keys can be used but are only listed by their start
+	long := "app/" + strings.Repeat("x", 300)
+	assert.Nil(t, sm.SaveSecret(ctx, long, "long"))
+	val, err = sm.GetSecret(ctx, long)
+	assert.Nil(t, err)
+	assert.Equal(t, "long", val)
+
+	var hashed []*SecretInfo
+	err = sm.ListSecretsEach(ctx, &ListSecretsOptions{Prefix: "app/x"}, func(secret *SecretInfo) error {
+		hashed = append(hashed, secret)
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Len(t, hashed, 1)
+	assert.True(t, hashed[0].Hashed)
+	assert.Equal(t, encodeSecretID(t, long), hashed[0].ID)
+}
+
+func TestSecretManagerLegacyIDs(t *testing.T) {
+	ctx := cloudy.StartContext()
+	fake, sm := startFakeSecretManager(t, "test-project")
+
+	// Secrets created before keys were encoded keep their ID
+	for _, key := range []string{"my_-secret", "legacy_-ab", "prod-db"} {
+		assert.Nil(t, sm.SaveSecret(ctx, key, key))
+		assert.Contains(t, fake.secrets, "projects/test-project/secrets/"+key)
+		val, err := sm.GetSecret(ctx, key)
+		assert.Nil(t, err)
+		assert.Equal(t, key, val)
+	}
+
+	keys, err := sm.ListSecrets(ctx, nil)
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, []string{"my_-secret", "legacy_-ab", "prod-db"}, keys)
+}
@@ -0,0 +1,87 @@
+package cloudygcp
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/appliedres/cloudy"
+)
+
+// SecretRetention limits the number of versions kept for each secret. Secret Manager bills
+// every active (enabled or disabled) version, and SaveSecret adds one on every call.
+type SecretRetention struct {
+	// Number of newest versions left untouched after a save, zero keeps every version
+	KeepVersions int
+	// Destroy the older versions instead of disabling them. Destroyed versions cannot be
+	// recovered, disabled ones can be enabled again but are still billed.
+	Destroy bool
+}
+
+// secretRetentionFromEnv reads the retention policy. Both keys are optional:
+//
+//	GCP_SECRET_KEEP_VERSIONS   number of versions kept, zero or unset keeps all
+//	GCP_SECRET_DESTROY_OLD     true to destroy old versions instead of disabling them
+func secretRetentionFromEnv(env *cloudy.Environment) (SecretRetention, error) {
+	retention := SecretRetention{}
+	if text := env.Get("GCP_SECRET_KEEP_VERSIONS"); text != "" {
+		n, err := strconv.Atoi(text)
+		if err != nil || n < 0 {
+			return retention, fmt.Errorf("invalid GCP_SECRET_KEEP_VERSIONS %q", text)
+		}
+		retention.KeepVersions = n
+	}
+	destroy, err := envBool(env, "GCP_SECRET_DESTROY_OLD")
+	if err != nil {
+		return retention, err
+	}
+	retention.Destroy = destroy != nil && *destroy
+	return retention, nil
+}
+
+// PruneSecretVersions applies the retention policy to the secret: all but the newest
+// KeepVersions versions are disabled, or destroyed. Versions that are already disabled
+// (or destroyed) are skipped. Returns the versions that were changed.
+//
+// A service pinned to an old version with GetSecretVersion loses access to it once it is
+// pruned, so keep enough versions to cover rollbacks.
+func (k *SecretManager) PruneSecretVersions(ctx context.Context, key string) ([]string, error) {
+	if k.Retention.KeepVersions <= 0 {
+		return nil, nil
+	}
+	versions, err := k.ListSecretVersions(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		return versionNumber(versions[i]) > versionNumber(versions[j])
+	})
+
+	pruned := []string{}
+	if len(versions) <= k.Retention.KeepVersions {
+		return pruned, nil
+	}
+	for _, v := range versions[k.Retention.KeepVersions:] {
+		switch {
+		case v.State == SecretVersionDestroyed:
+			continue
+		case k.Retention.Destroy:
+			err = k.DestroySecretVersion(ctx, key, v.Version)
+		case v.State == SecretVersionEnabled:
+			err = k.DisableSecretVersion(ctx, key, v.Version)
+		default:
+			continue
+		}
+		if err != nil {
+			return pruned, err
+		}
+		pruned = append(pruned, v.Version)
+	}
+	return pruned, nil
+}
+
+func versionNumber(v *SecretVersion) int {
+	n, _ := strconv.Atoi(v.Version)
+	return n
+}
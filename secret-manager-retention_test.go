@@ -0,0 +1,92 @@
+package cloudygcp
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/appliedres/cloudy"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+)
+
+func TestSecretRetentionDisable(t *testing.T) {
+	ctx := cloudy.StartContext()
+	_, sm := startFakeSecretManager(t, "test-project")
+	sm.Retention = SecretRetention{KeepVersions: 2}
+
+	for i := 1; i <= 5; i++ {
+		assert.Nil(t, sm.SaveSecret(ctx, "token", fmt.Sprint("value", i)))
+	}
+
+	versions, err := sm.ListSecretVersions(ctx, "token")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]SecretVersionState{
+		"1": SecretVersionDisabled,
+		"2": SecretVersionDisabled,
+		"3": SecretVersionDisabled,
+		"4": SecretVersionEnabled,
+		"5": SecretVersionEnabled,
+	}, secretVersionStates(versions))
+
+	val, err := sm.GetSecret(ctx, "token")
+	assert.Nil(t, err)
+	assert.Equal(t, "value5", val)
+
+	// Disabled versions can be brought back for a rollback
+	assert.Nil(t, sm.EnableSecretVersion(ctx, "token", "3"))
+	val, err = sm.GetSecretVersion(ctx, "token", "3")
+	assert.Nil(t, err)
+	assert.Equal(t, "value3", val)
+}
+
+func TestSecretRetentionDestroy(t *testing.T) {
+	ctx := cloudy.StartContext()
+	_, sm := startFakeSecretManager(t, "test-project")
+
+	// Versions saved before the policy is set are pruned by the next save
+	for i := 1; i <= 3; i++ {
+		assert.Nil(t, sm.SaveSecret(ctx, "token", fmt.Sprint("value", i)))
+	}
+	assert.Nil(t, sm.DisableSecretVersion(ctx, "token", "2"))
+
+	sm.Retention = SecretRetention{KeepVersions: 1, Destroy: true}
+	assert.Nil(t, sm.SaveSecret(ctx, "token", "value4"))
+
+	versions, err := sm.ListSecretVersions(ctx, "token")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]SecretVersionState{
+		"1": SecretVersionDestroyed,
+		"2": SecretVersionDestroyed,
+		"3": SecretVersionDestroyed,
+		"4": SecretVersionEnabled,
+	}, secretVersionStates(versions))
+
+	pruned, err := sm.PruneSecretVersions(ctx, "token")
+	assert.Nil(t, err)
+	assert.Empty(t, pruned)
+}
+
+func TestSecretRetentionFailure(t *testing.T) {
+	ctx := cloudy.StartContext()
+	fake, sm := startFakeSecretManager(t, "test-project")
+	sm.Retention = SecretRetention{KeepVersions: 1}
+
+	assert.Nil(t, sm.SaveSecret(ctx, "token", "one"))
+	fake.fail("DisableSecretVersion", "projects/test-project/secrets/token", codes.PermissionDenied)
+
+	// The save succeeds, the old version is left for a later prune
+	assert.Nil(t, sm.SaveSecret(ctx, "token", "two"))
+	val, err := sm.GetSecret(ctx, "token")
+	assert.Nil(t, err)
+	assert.Equal(t, "two", val)
+
+	versions, err := sm.ListSecretVersions(ctx, "token")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]SecretVersionState{
+		"1": SecretVersionEnabled,
+		"2": SecretVersionEnabled,
+	}, secretVersionStates(versions))
+
+	_, err = sm.PruneSecretVersions(ctx, "token")
+	assert.True(t, IsForbidden(err))
+}
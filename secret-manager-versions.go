@@ -0,0 +1,140 @@
+package cloudygcp
+
+import (
+	"context"
+	"hash/crc32"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/secretmanager/apiv1/secretmanagerpb"
+	"github.com/appliedres/cloudy"
+	"google.golang.org/api/iterator"
+)
+
+// SecretVersionState is the state of a secret version
+type SecretVersionState string
+
+const (
+	// SecretVersionEnabled versions can be read
+	SecretVersionEnabled SecretVersionState = "ENABLED"
+	// SecretVersionDisabled versions cannot be read until they are enabled again
+	SecretVersionDisabled SecretVersionState = "DISABLED"
+	// SecretVersionDestroyed versions have lost their data for good
+	SecretVersionDestroyed SecretVersionState = "DESTROYED"
+)
+
+// SecretVersion describes one version of a secret
+type SecretVersion struct {
+	// Version number, as used by the version calls
+	Version   string
+	State     SecretVersionState
+	Created   time.Time
+	Destroyed time.Time
+}
+
+// GetSecretVersionBinary reads a specific version of the secret, "latest" for the newest
+// one. Unlike GetSecretBinary a missing version is an error (cloudy.ErrKeyNotFound), and
+// disabled or destroyed versions fail with ErrPreconditionFailed.
+func (k *SecretManager) GetSecretVersionBinary(ctx context.Context, key string, version string) ([]byte, error) {
+	name, err := k.toNameVersion(ctx, key, version)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := k.Client.AccessSecretVersion(ctx, &secretmanagerpb.AccessSecretVersionRequest{
+		Name: name,
+	})
+	if err != nil {
+		return nil, classifyGrpcError(err)
+	}
+
+	//  Verify the data checksum, versions added without one cannot be verified
+	crc32c := crc32.MakeTable(crc32.Castagnoli)
+	checksum := int64(crc32.Checksum(resp.Payload.Data, crc32c))
+	if resp.Payload.DataCrc32C != nil && checksum != *resp.Payload.DataCrc32C {
+		return nil, cloudy.Error(ctx, "Data corruption detected in secret %v version %v", key, version)
+	}
+	return resp.Payload.Data, nil
+}
+
+// GetSecretVersion reads a specific version of the secret as a string
+func (k *SecretManager) GetSecretVersion(ctx context.Context, key string, version string) (string, error) {
+	data, err := k.GetSecretVersionBinary(ctx, key, version)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// ListSecretVersions lists every version of the secret, including disabled and destroyed
+// ones, newest first
+func (k *SecretManager) ListSecretVersions(ctx context.Context, key string) ([]*SecretVersion, error) {
+	name, err := k.toName(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	it := k.Client.ListSecretVersions(ctx, &secretmanagerpb.ListSecretVersionsRequest{
+		Parent: name,
+	})
+
+	versions := []*SecretVersion{}
+	for {
+		v, err := it.Next()
+		if err == iterator.Done {
+			return versions, nil
+		}
+		if err != nil {
+			return nil, classifyGrpcError(err)
+		}
+		versions = append(versions, toSecretVersion(v))
+	}
+}
+
+// DisableSecretVersion makes the version unreadable, it can be enabled again
+func (k *SecretManager) DisableSecretVersion(ctx context.Context, key string, version string) error {
+	name, err := k.toNameVersion(ctx, key, version)
+	if err != nil {
+		return err
+	}
+	_, err = k.Client.DisableSecretVersion(ctx, &secretmanagerpb.DisableSecretVersionRequest{
+		Name: name,
+	})
+	return classifyGrpcError(err)
+}
+
+// EnableSecretVersion makes a disabled version readable again
+func (k *SecretManager) EnableSecretVersion(ctx context.Context, key string, version string) error {
+	name, err := k.toNameVersion(ctx, key, version)
+	if err != nil {
+		return err
+	}
+	_, err = k.Client.EnableSecretVersion(ctx, &secretmanagerpb.EnableSecretVersionRequest{
+		Name: name,
+	})
+	return classifyGrpcError(err)
+}
+
+// DestroySecretVersion permanently erases the data of the version
+func (k *SecretManager) DestroySecretVersion(ctx context.Context, key string, version string) error {
+	name, err := k.toNameVersion(ctx, key, version)
+	if err != nil {
+		return err
+	}
+	_, err = k.Client.DestroySecretVersion(ctx, &secretmanagerpb.DestroySecretVersionRequest{
+		Name: name,
+	})
+	return classifyGrpcError(err)
+}
+
+func toSecretVersion(v *secretmanagerpb.SecretVersion) *SecretVersion {
+	version := &SecretVersion{
+		Version: v.Name[strings.LastIndex(v.Name, "/")+1:],
+		State:   SecretVersionState(v.State.String()),
+	}
+	if v.CreateTime != nil {
+		version.Created = v.CreateTime.AsTime()
+	}
+	if v.DestroyTime != nil {
+		version.Destroyed = v.DestroyTime.AsTime()
+	}
+	return version
+}
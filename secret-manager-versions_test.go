@@ -0,0 +1,79 @@
+package cloudygcp
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/appliedres/cloudy"
+	"github.com/stretchr/testify/assert"
+)
+
+func secretVersionStates(versions []*SecretVersion) map[string]SecretVersionState {
+	states := make(map[string]SecretVersionState)
+	for _, v := range versions {
+		states[v.Version] = v.State
+	}
+	return states
+}
+
+func TestSecretManagerVersions(t *testing.T) {
+	ctx := cloudy.StartContext()
+	fake, sm := startFakeSecretManager(t, "test-project")
+
+	for _, value := range []string{"one", "two", "three"} {
+		assert.Nil(t, sm.SaveSecret(ctx, "api-key", value))
+	}
+
+	versions, err := sm.ListSecretVersions(ctx, "api-key")
+	assert.Nil(t, err)
+	assert.Len(t, versions, 3)
+	assert.Equal(t, "3", versions[0].Version)
+	assert.Equal(t, SecretVersionEnabled, versions[0].State)
+	assert.False(t, versions[0].Created.IsZero())
+
+	// Pin a service to an older version
+	val, err := sm.GetSecretVersion(ctx, "api-key", "2")
+	assert.Nil(t, err)
+	assert.Equal(t, "two", val)
+
+	_, err = sm.GetSecretVersion(ctx, "api-key", "9")
+	assert.True(t, errors.Is(err, cloudy.ErrKeyNotFound))
+
+	// Disabled versions cannot be read until they are enabled again
+	assert.Nil(t, sm.DisableSecretVersion(ctx, "api-key", "2"))
+	_, err = sm.GetSecretVersion(ctx, "api-key", "2")
+	assert.True(t, IsPreconditionFailed(err))
+	assert.Nil(t, sm.EnableSecretVersion(ctx, "api-key", "2"))
+	val, err = sm.GetSecretVersion(ctx, "api-key", "2")
+	assert.Nil(t, err)
+	assert.Equal(t, "two", val)
+
+	assert.Nil(t, sm.DestroySecretVersion(ctx, "api-key", "1"))
+	assert.True(t, IsPreconditionFailed(sm.EnableSecretVersion(ctx, "api-key", "1")))
+
+	versions, err = sm.ListSecretVersions(ctx, "api-key")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]SecretVersionState{
+		"1": SecretVersionDestroyed,
+		"2": SecretVersionEnabled,
+		"3": SecretVersionEnabled,
+	}, secretVersionStates(versions))
+	assert.False(t, versions[2].Destroyed.IsZero())
+
+	// latest is the newest version, even when it is disabled
+	assert.Nil(t, sm.DisableSecretVersion(ctx, "api-key", "3"))
+	_, err = sm.GetSecretVersion(ctx, "api-key", "latest")
+	assert.True(t, IsPreconditionFailed(err))
+	assert.Nil(t, sm.EnableSecretVersion(ctx, "api-key", "3"))
+
+	// Versions added without a checksum are returned unverified
+	fake.setOmitChecksums(true)
+	val, err = sm.GetSecretVersion(ctx, "api-key", "3")
+	assert.Nil(t, err)
+	assert.Equal(t, "three", val)
+	fake.setOmitChecksums(false)
+
+	_, err = sm.ListSecretVersions(ctx, "missing")
+	assert.True(t, errors.Is(err, cloudy.ErrKeyNotFound))
+	assert.True(t, sm.IsNotFound(sm.DisableSecretVersion(ctx, "missing", "1")))
+}
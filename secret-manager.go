@@ -2,14 +2,14 @@ package cloudygcp
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"hash/crc32"
-	"log"
 
 	secretmanager "cloud.google.com/go/secretmanager/apiv1"
 	"cloud.google.com/go/secretmanager/apiv1/secretmanagerpb"
 	"github.com/appliedres/cloudy"
 	"github.com/appliedres/cloudy/secrets"
+	"google.golang.org/grpc/codes"
 )
 
 const GoogleSecretsManager = "gcp-secrets"
@@ -23,7 +23,8 @@ type SecretManagerFactory struct{}
 
 type SecretManagerConfig struct {
 	GcpCredentials
-	Project string
+	Project   string
+	Retention SecretRetention
 }
 
 func (c *SecretManagerFactory) Create(cfg interface{}) (secrets.SecretProvider, error) {
@@ -31,13 +32,24 @@ func (c *SecretManagerFactory) Create(cfg interface{}) (secrets.SecretProvider,
 	if sec == nil {
 		return nil, cloudy.ErrInvalidConfiguration
 	}
-	return NewSecretManager(context.Background(), sec.Project, sec.GcpCredentials)
+	sm, err := NewSecretManager(context.Background(), sec.Project, sec.GcpCredentials)
+	if err != nil {
+		return nil, err
+	}
+	sm.Retention = sec.Retention
+	return sm, nil
 }
 
 func (c *SecretManagerFactory) FromEnv(env *cloudy.Environment) (interface{}, error) {
 	cfg := &SecretManagerConfig{}
 	cfg.Project = env.Force("GCP_PROJECT")
-	cfg.GcpCredentials = GetCredentialsFromEnv()
+	cfg.GcpCredentials = GetCredentialsFromEnv(env)
+
+	retention, err := secretRetentionFromEnv(env)
+	if err != nil {
+		return nil, err
+	}
+	cfg.Retention = retention
 	return cfg, nil
 }
 
@@ -45,6 +57,8 @@ type SecretManager struct {
 	GcpCredentials
 	Project string
 	Client  *secretmanager.Client
+	// Applied after each save, see PruneSecretVersions
+	Retention SecretRetention
 }
 
 func NewSecretManager(ctx context.Context, project string, credentials GcpCredentials) (*SecretManager, error) {
@@ -57,14 +71,12 @@ func NewSecretManager(ctx context.Context, project string, credentials GcpCreden
 }
 
 func (k *SecretManager) Configure(ctx context.Context) error {
+	opts, err := k.GcpCredentials.ClientOptions(ctx)
+	if err != nil {
+		return err
+	}
 
-	// cred, err := GetCredentials(k.GcpCredentials)
-	// if err != nil {
-	// 	return err
-	// }
-
-	// client := secretmanagerpb.NewSecretManagerServiceClient(creds)
-	client, err := secretmanager.NewClient(ctx)
+	client, err := secretmanager.NewClient(ctx, opts...)
 	if err != nil {
 		return err
 	}
@@ -74,7 +86,11 @@ func (k *SecretManager) Configure(ctx context.Context) error {
 }
 
 func (k *SecretManager) SaveSecretBinary(ctx context.Context, key string, secret []byte) error {
-	name := k.toName(ctx, key)
+	id, err := EncodeSecretID(key)
+	if err != nil {
+		return cloudy.Error(ctx, "Secret(%q): %v", key, err)
+	}
+	name := k.secretName(id)
 
 	// So GCP is a bit stupid here. They require that you "create" a secret first and then
 	// set a secret version. This means we first have to "Get" the secret to see if
@@ -82,19 +98,15 @@ func (k *SecretManager) SaveSecretBinary(ctx context.Context, key string, secret
 	s, err := k.Client.GetSecret(ctx, &secretmanagerpb.GetSecretRequest{
 		Name: name,
 	})
-	if err != nil {
-		if k.IsNotFound(err) {
-			// This is ok
-		} else {
-			return err
-		}
+	if err != nil && !k.IsNotFound(err) {
+		return classifyGrpcError(err)
 	}
 
 	if s == nil {
 		// Secret is not there so we need to create it
 		_, err = k.Client.CreateSecret(ctx, &secretmanagerpb.CreateSecretRequest{
 			Parent:   "projects/" + k.Project,
-			SecretId: key,
+			SecretId: id,
 			Secret: &secretmanagerpb.Secret{
 				Replication: &secretmanagerpb.Replication{
 					Replication: &secretmanagerpb.Replication_Automatic_{
@@ -104,8 +116,9 @@ func (k *SecretManager) SaveSecretBinary(ctx context.Context, key string, secret
 			},
 		})
 
-		if err != nil {
-			return err
+		// Someone else may have created it in the meantime, which is fine
+		if err != nil && grpcCode(err) != codes.AlreadyExists {
+			return classifyGrpcError(err)
 		}
 	}
 
@@ -116,33 +129,24 @@ func (k *SecretManager) SaveSecretBinary(ctx context.Context, key string, secret
 		},
 	}
 	_, err = k.Client.AddSecretVersion(ctx, addSecretVersionReq)
-
-	return err
-}
-
-func (k *SecretManager) GetSecretBinary(ctx context.Context, key string) ([]byte, error) {
-	name := k.toNameVersion(ctx, key, "latest")
-
-	resp, err := k.Client.AccessSecretVersion(ctx, &secretmanagerpb.AccessSecretVersionRequest{
-		Name: name,
-	})
-
 	if err != nil {
-		if k.IsNotFound(err) {
-			return nil, nil
-		}
-		return nil, err
+		return classifyGrpcError(err)
 	}
 
-	//  Verify the data checksum.
-	crc32c := crc32.MakeTable(crc32.Castagnoli)
-	checksum := int64(crc32.Checksum(resp.Payload.Data, crc32c))
-	if checksum != *resp.Payload.DataCrc32C {
-		return nil, cloudy.Error(ctx, "Data corruption detected in secret %v", key)
+	// The save succeeded, old versions that cannot be pruned are left for the next save
+	// or an explicit PruneSecretVersions
+	if _, err = k.PruneSecretVersions(ctx, key); err != nil {
+		cloudy.Warn(ctx, "Secret %v saved but old versions not pruned: %v", key, err)
 	}
+	return nil
+}
 
-	secretData := resp.Payload.Data
-	return secretData, nil
+func (k *SecretManager) GetSecretBinary(ctx context.Context, key string) ([]byte, error) {
+	data, err := k.GetSecretVersionBinary(ctx, key, "latest")
+	if k.IsNotFound(err) {
+		return nil, nil
+	}
+	return data, err
 }
 
 func (k *SecretManager) GetSecret(ctx context.Context, key string) (string, error) {
@@ -159,38 +163,47 @@ func (k *SecretManager) SaveSecret(ctx context.Context, key string, data string)
 }
 
 func (k *SecretManager) DeleteSecret(ctx context.Context, key string) error {
-	name := k.toName(ctx, key)
-	err := k.Client.DeleteSecret(ctx, &secretmanagerpb.DeleteSecretRequest{
+	name, err := k.toName(ctx, key)
+	if err != nil {
+		return err
+	}
+	err = k.Client.DeleteSecret(ctx, &secretmanagerpb.DeleteSecretRequest{
 		Name: name,
 	})
 
-	return err
+	return classifyGrpcError(err)
 }
 
+// IsNotFound returns true if the error indicates that the secret (or version) does not exist
 func (k *SecretManager) IsNotFound(err error) bool {
-	// Not sure yet
-	log.Printf("Potential Error: %v\n", err)
-
-	return true
+	if err == nil {
+		return false
+	}
+	return grpcCode(err) == codes.NotFound || errors.Is(err, cloudy.ErrKeyNotFound)
 }
 
-func sanitizeName(secretName string) string {
-	// CHeck with google on valid secret names
-	return secretName
+// Format projects/my-project/secrets/my-secret
+func (k *SecretManager) toName(ctx context.Context, key string) (string, error) {
+	id, err := EncodeSecretID(key)
+	if err != nil {
+		return "", cloudy.Error(ctx, "Secret(%q): %v", key, err)
+	}
+	return k.secretName(id), nil
 }
 
-// Format projects/my-project/secrets/my-secret/versions/5
-func (k *SecretManager) toName(ctx context.Context, key string) string {
-	key = sanitizeName(key)
-
-	return fmt.Sprintf("projects/%v/secrets/%v", k.Project, key)
+// secretName returns the resource name of the secret ID
+func (k *SecretManager) secretName(id string) string {
+	return fmt.Sprintf("projects/%v/secrets/%v", k.Project, id)
 }
 
 // Format projects/my-project/secrets/my-secret/versions/5
-func (k *SecretManager) toNameVersion(ctx context.Context, key string, version string) string {
-	key = sanitizeName(key)
+func (k *SecretManager) toNameVersion(ctx context.Context, key string, version string) (string, error) {
+	name, err := k.toName(ctx, key)
+	if err != nil {
+		return "", err
+	}
 	if version == "" {
 		version = "latest"
 	}
-	return fmt.Sprintf("projects/%v/secrets/%v/versions/%v", k.Project, key, version)
+	return fmt.Sprintf("%v/versions/%v", name, version), nil
 }
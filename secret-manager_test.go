@@ -1,12 +1,15 @@
 package cloudygcp
 
 import (
+	"errors"
 	"log"
 	"testing"
 
 	"github.com/appliedres/cloudy"
 	"github.com/appliedres/cloudy/secrets"
 	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 func TestSecretManager(t *testing.T) {
@@ -20,3 +23,98 @@ func TestSecretManager(t *testing.T) {
 
 	secrets.SecretsTest(t, ctx, sm)
 }
+
+func TestSecretManagerFake(t *testing.T) {
+	ctx := cloudy.StartContext()
+	_, sm := startFakeSecretManager(t, "test-project")
+
+	secrets.SecretsTest(t, ctx, sm)
+}
+
+func TestSecretManagerNotFound(t *testing.T) {
+	ctx := cloudy.StartContext()
+	_, sm := startFakeSecretManager(t, "test-project")
+
+	// Missing secrets read as empty
+	data, err := sm.GetSecretBinary(ctx, "missing")
+	assert.Nil(t, err)
+	assert.Nil(t, data)
+
+	err = sm.DeleteSecret(ctx, "missing")
+	assert.True(t, errors.Is(err, cloudy.ErrKeyNotFound))
+	assert.True(t, sm.IsNotFound(err))
+
+	err = sm.SaveSecret(ctx, "present", "one")
+	assert.Nil(t, err)
+	err = sm.SaveSecret(ctx, "present", "two")
+	assert.Nil(t, err)
+
+	val, err := sm.GetSecret(ctx, "present")
+	assert.Nil(t, err)
+	assert.Equal(t, "two", val)
+
+	err = sm.DeleteSecret(ctx, "present")
+	assert.Nil(t, err)
+}
+
+func TestSecretManagerPermissionDenied(t *testing.T) {
+	ctx := cloudy.StartContext()
+	fake, sm := startFakeSecretManager(t, "test-project")
+	name := "projects/test-project/secrets/locked"
+
+	fake.fail("AccessSecretVersion", name, codes.PermissionDenied)
+	_, err := sm.GetSecret(ctx, "locked")
+	assert.True(t, errors.Is(err, ErrPermissionDenied))
+	assert.False(t, errors.Is(err, cloudy.ErrKeyNotFound))
+	assert.False(t, sm.IsNotFound(err))
+
+	// A failed lookup must not lead to creating the secret
+	fake.fail("GetSecret", name, codes.PermissionDenied)
+	err = sm.SaveSecret(ctx, "locked", "value")
+	assert.True(t, errors.Is(err, ErrPermissionDenied))
+	assert.NotContains(t, fake.secrets, name)
+}
+
+func TestSecretManagerCreateRace(t *testing.T) {
+	ctx := cloudy.StartContext()
+	fake, sm := startFakeSecretManager(t, "test-project")
+	name := "projects/test-project/secrets/racy"
+
+	err := sm.SaveSecret(ctx, "racy", "one")
+	assert.Nil(t, err)
+
+	// Looks missing, but create reports it already exists
+	fake.fail("GetSecret", name, codes.NotFound)
+	err = sm.SaveSecret(ctx, "racy", "two")
+	assert.Nil(t, err)
+
+	val, err := sm.GetSecret(ctx, "racy")
+	assert.Nil(t, err)
+	assert.Equal(t, "two", val)
+}
+
+func TestClassifyGrpcError(t *testing.T) {
+	tests := []struct {
+		code codes.Code
+		want error
+	}{
+		{codes.NotFound, cloudy.ErrKeyNotFound},
+		{codes.PermissionDenied, ErrPermissionDenied},
+		{codes.Unauthenticated, ErrUnauthenticated},
+		{codes.AlreadyExists, ErrAlreadyExists},
+		{codes.FailedPrecondition, ErrPreconditionFailed},
+		{codes.ResourceExhausted, ErrRateLimited},
+		{codes.Unavailable, ErrUnavailable},
+	}
+
+	for _, tt := range tests {
+		original := status.Error(tt.code, "failed")
+		err := classifyGrpcError(original)
+		assert.True(t, errors.Is(err, tt.want), tt.code.String())
+		assert.Equal(t, tt.code, status.Code(errors.Unwrap(err)))
+	}
+
+	err := classifyGrpcError(status.Error(codes.Internal, "failed"))
+	assert.Equal(t, codes.Internal, status.Code(err))
+	assert.Nil(t, classifyGrpcError(nil))
+}
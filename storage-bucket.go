@@ -0,0 +1,309 @@
+package cloudygcp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/iam"
+	"cloud.google.com/go/storage"
+	"github.com/appliedres/cloudy"
+	"google.golang.org/api/googleapi"
+)
+
+// BucketOptions are the settings of a bucket. Empty and nil fields are left to the GCS
+// defaults when creating a bucket and unchanged by UpdateBucket.
+type BucketOptions struct {
+	// Location (region, dual-region or multi-region) of the bucket, only set on creation
+	Location string
+	// Default storage class of new objects
+	StorageClass string
+	// Keep noncurrent versions of objects that are overwritten or deleted
+	Versioning *bool
+	// Minimum time objects are kept, zero removes the retention policy
+	RetentionPeriod *time.Duration
+	// Time deleted objects can be restored, zero disables soft delete
+	SoftDeleteRetention *time.Duration
+	// Cloud KMS key used to encrypt new objects (CMEK)
+	KMSKeyName string
+	// Bill the requester for access to the bucket
+	RequesterPays *bool
+}
+
+// CreateBucketOptions controls CreateWithOptions. Unset bucket options are taken from
+// the defaults of the GoogleCloudStorage.
+type CreateBucketOptions struct {
+	BucketOptions
+
+	// Grant allUsers read access, see Create
+	OpenToPublic bool
+	Tags         map[string]string
+}
+
+// bucketOptionsFromEnv reads the default bucket options. The following keys are used, all
+// of which are optional:
+//
+//	GCP_STORAGE_LOCATION              location of new buckets
+//	GCP_STORAGE_CLASS                 default storage class
+//	GCP_STORAGE_VERSIONING            true to keep noncurrent versions
+//	GCP_STORAGE_RETENTION_PERIOD      retention policy, as a Go duration
+//	GCP_STORAGE_SOFT_DELETE_RETENTION soft delete retention, as a Go duration
+//	GCP_STORAGE_KMS_KEY               default CMEK key
+//	GCP_STORAGE_REQUESTER_PAYS        true to bill requesters
+func bucketOptionsFromEnv(env *cloudy.Environment) (BucketOptions, error) {
+	opts := BucketOptions{
+		Location:     env.Get("GCP_STORAGE_LOCATION"),
+		StorageClass: env.Get("GCP_STORAGE_CLASS"),
+		KMSKeyName:   env.Get("GCP_STORAGE_KMS_KEY"),
+	}
+
+	var err error
+	if opts.Versioning, err = envBool(env, "GCP_STORAGE_VERSIONING"); err != nil {
+		return opts, err
+	}
+	if opts.RequesterPays, err = envBool(env, "GCP_STORAGE_REQUESTER_PAYS"); err != nil {
+		return opts, err
+	}
+	if opts.RetentionPeriod, err = envDuration(env, "GCP_STORAGE_RETENTION_PERIOD"); err != nil {
+		return opts, err
+	}
+	if opts.SoftDeleteRetention, err = envDuration(env, "GCP_STORAGE_SOFT_DELETE_RETENTION"); err != nil {
+		return opts, err
+	}
+	return opts, nil
+}
+
+func envBool(env *cloudy.Environment, name string) (*bool, error) {
+	text := env.Get(name)
+	if text == "" {
+		return nil, nil
+	}
+	v, err := strconv.ParseBool(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %v: %w", name, err)
+	}
+	return &v, nil
+}
+
+func envDuration(env *cloudy.Environment, name string) (*time.Duration, error) {
+	text := env.Get(name)
+	if text == "" {
+		return nil, nil
+	}
+	v, err := time.ParseDuration(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %v: %w", name, err)
+	}
+	return &v, nil
+}
+
+// withDefaults returns the options with the unset fields taken from defaults
+func (opts BucketOptions) withDefaults(defaults BucketOptions) BucketOptions {
+	if opts.Location == "" {
+		opts.Location = defaults.Location
+	}
+	if opts.StorageClass == "" {
+		opts.StorageClass = defaults.StorageClass
+	}
+	if opts.Versioning == nil {
+		opts.Versioning = defaults.Versioning
+	}
+	if opts.RetentionPeriod == nil {
+		opts.RetentionPeriod = defaults.RetentionPeriod
+	}
+	if opts.SoftDeleteRetention == nil {
+		opts.SoftDeleteRetention = defaults.SoftDeleteRetention
+	}
+	if opts.KMSKeyName == "" {
+		opts.KMSKeyName = defaults.KMSKeyName
+	}
+	if opts.RequesterPays == nil {
+		opts.RequesterPays = defaults.RequesterPays
+	}
+	return opts
+}
+
+// CreateWithOptions creates a bucket with the given settings. The storage client cannot
+// set a soft delete policy, so it is applied with a second request once the bucket exists.
+// When that request, or the public grant, fails the new bucket is deleted again.
+func (gcps *GoogleCloudStorage) CreateWithOptions(ctx context.Context, key string, opts *CreateBucketOptions) (*GoogleCloudStorageBucket, error) {
+	if opts == nil {
+		opts = &CreateBucketOptions{}
+	}
+	settings := opts.BucketOptions.withDefaults(gcps.Defaults)
+	bucket := gcps.Client.Bucket(key)
+
+	attrs := &storage.BucketAttrs{
+		Labels:       prepareTags(ctx, opts.Tags),
+		Location:     settings.Location,
+		StorageClass: settings.StorageClass,
+	}
+	if settings.Versioning != nil {
+		attrs.VersioningEnabled = *settings.Versioning
+	}
+	if settings.RequesterPays != nil {
+		attrs.RequesterPays = *settings.RequesterPays
+	}
+	if settings.RetentionPeriod != nil && *settings.RetentionPeriod > 0 {
+		attrs.RetentionPolicy = &storage.RetentionPolicy{RetentionPeriod: *settings.RetentionPeriod}
+	}
+	if settings.KMSKeyName != "" {
+		attrs.Encryption = &storage.BucketEncryption{DefaultKMSKeyName: settings.KMSKeyName}
+	}
+
+	// Public buckets are granted access at the bucket level so uniform access is required.
+	// Private buckets are locked down so that nothing inside can be made public later.
+	if opts.OpenToPublic {
+		attrs.UniformBucketLevelAccess = storage.UniformBucketLevelAccess{Enabled: true}
+		attrs.PublicAccessPrevention = storage.PublicAccessPreventionInherited
+	} else {
+		attrs.PublicAccessPrevention = storage.PublicAccessPreventionEnforced
+	}
+
+	err := bucket.Create(ctx, gcps.Project, attrs)
+	if err != nil {
+		return nil, classifyStorageError(fmt.Errorf("Bucket(%q).Create: %w", key, err))
+	}
+
+	if settings.SoftDeleteRetention != nil {
+		if err = gcps.setSoftDeleteRetention(ctx, key, *settings.SoftDeleteRetention); err != nil {
+			return nil, gcps.abandonBucket(ctx, key, err)
+		}
+	}
+
+	if opts.OpenToPublic {
+		if err = gcps.grantPublicRead(ctx, key); err != nil {
+			return nil, gcps.abandonBucket(ctx, key, err)
+		}
+	}
+
+	return gcps.bucket(key), nil
+}
+
+// grantPublicRead grants allUsers the PublicReaderRole on the bucket
+func (gcps *GoogleCloudStorage) grantPublicRead(ctx context.Context, key string) error {
+	_, err := gcps.AddBinding(ctx, key, string(PublicReaderRole), iam.AllUsers, nil)
+	return err
+}
+
+// abandonBucket deletes a bucket that was created but could not be set up, so that the
+// creation can be retried. When it cannot be deleted the error says that it exists.
+func (gcps *GoogleCloudStorage) abandonBucket(ctx context.Context, key string, cause error) error {
+	if err := gcps.Client.Bucket(key).Delete(ctx); err != nil {
+		return fmt.Errorf("bucket %v was created but not set up, and could not be deleted (%v): %w", key, err, cause)
+	}
+	return cause
+}
+
+// UpdateBucket changes the settings of an existing bucket. The location of a bucket
+// cannot be changed. Returns the updated bucket.
+func (gcps *GoogleCloudStorage) UpdateBucket(ctx context.Context, key string, opts *BucketOptions) (*GoogleStorageArea, error) {
+	if opts == nil {
+		opts = &BucketOptions{}
+	}
+	if opts.Location != "" {
+		return nil, cloudy.Error(ctx, "UpdateBucket(%q): the location of a bucket cannot be changed", key)
+	}
+
+	update := storage.BucketAttrsToUpdate{
+		StorageClass: opts.StorageClass,
+	}
+	changed := opts.StorageClass != ""
+	if opts.Versioning != nil {
+		update.VersioningEnabled = *opts.Versioning
+		changed = true
+	}
+	if opts.RequesterPays != nil {
+		update.RequesterPays = *opts.RequesterPays
+		changed = true
+	}
+	if opts.RetentionPeriod != nil {
+		update.RetentionPolicy = &storage.RetentionPolicy{RetentionPeriod: *opts.RetentionPeriod}
+		changed = true
+	}
+	if opts.KMSKeyName != "" {
+		update.Encryption = &storage.BucketEncryption{DefaultKMSKeyName: opts.KMSKeyName}
+		changed = true
+	}
+
+	if changed {
+		_, err := gcps.Client.Bucket(key).Update(ctx, update)
+		if err != nil {
+			return nil, classifyStorageError(fmt.Errorf("Bucket(%q).Update: %w", key, err))
+		}
+	}
+	if opts.SoftDeleteRetention != nil {
+		if err := gcps.setSoftDeleteRetention(ctx, key, *opts.SoftDeleteRetention); err != nil {
+			return nil, err
+		}
+	}
+	return gcps.GetItemDetails(ctx, key)
+}
+
+// softDeletePolicy is the part of the JSON API bucket resource that the storage client
+// does not support yet
+type softDeletePolicy struct {
+	SoftDeletePolicy *struct {
+		RetentionDurationSeconds int64 `json:"retentionDurationSeconds,string"`
+	} `json:"softDeletePolicy,omitempty"`
+}
+
+// setSoftDeleteRetention patches the soft delete policy through the JSON API
+func (gcps *GoogleCloudStorage) setSoftDeleteRetention(ctx context.Context, key string, retention time.Duration) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"softDeletePolicy": map[string]string{
+			"retentionDurationSeconds": strconv.FormatInt(int64(retention/time.Second), 10),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = gcps.bucketJSON(ctx, http.MethodPatch, key, body)
+	return err
+}
+
+// softDeleteRetention reads the soft delete policy, nil when the bucket has none
+func (gcps *GoogleCloudStorage) softDeleteRetention(ctx context.Context, key string) (*time.Duration, error) {
+	policy, err := gcps.bucketJSON(ctx, http.MethodGet, key, nil)
+	if err != nil || policy.SoftDeletePolicy == nil {
+		return nil, err
+	}
+	retention := time.Duration(policy.SoftDeletePolicy.RetentionDurationSeconds) * time.Second
+	return &retention, nil
+}
+
+func (gcps *GoogleCloudStorage) bucketJSON(ctx context.Context, method string, key string, body []byte) (*softDeletePolicy, error) {
+	hc, endpoint, err := gcps.bucket(key).httpClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	u := endpoint + "b/" + url.PathEscape(key) + "?fields=softDeletePolicy"
+	req, err := http.NewRequestWithContext(ctx, method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	}
+
+	res, err := hc.Do(req)
+	if err != nil {
+		return nil, classifyStorageError(fmt.Errorf("Bucket(%q) soft delete policy: %w", key, err))
+	}
+	defer res.Body.Close()
+	if err = googleapi.CheckResponse(res); err != nil {
+		return nil, classifyStorageError(fmt.Errorf("Bucket(%q) soft delete policy: %w", key, err))
+	}
+
+	policy := &softDeletePolicy{}
+	if err = json.NewDecoder(res.Body).Decode(policy); err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
@@ -0,0 +1,100 @@
+package cloudygcp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/appliedres/cloudy"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCreateWithOptions(t *testing.T) {
+	ctx := cloudy.StartContext()
+	_, gcs := startFakeStorage(t)
+
+	versioning := true
+	softDelete := 14 * 24 * time.Hour
+	gcs.Defaults = BucketOptions{
+		Location:            "EUROPE-WEST1",
+		StorageClass:        StorageClassNearline,
+		Versioning:          &versioning,
+		SoftDeleteRetention: &softDelete,
+	}
+
+	retention := 24 * time.Hour
+	_, err := gcs.CreateWithOptions(ctx, "configured", &CreateBucketOptions{
+		BucketOptions: BucketOptions{
+			StorageClass:    StorageClassColdline,
+			RetentionPeriod: &retention,
+			KMSKeyName:      "projects/p/locations/europe-west1/keyRings/r/cryptoKeys/k",
+		},
+		Tags: map[string]string{"team": "data"},
+	})
+	assert.Nil(t, err)
+
+	area, err := gcs.GetItemDetails(ctx, "configured")
+	assert.Nil(t, err)
+	assert.Equal(t, "data", area.Tags["team"])
+	assert.Equal(t, "EUROPE-WEST1", area.Location)
+	assert.Equal(t, StorageClassColdline, area.StorageClass)
+	assert.True(t, area.VersioningEnabled)
+	assert.Equal(t, retention, area.RetentionPeriod)
+	assert.Equal(t, "projects/p/locations/europe-west1/keyRings/r/cryptoKeys/k", area.KMSKeyName)
+	assert.False(t, area.RequesterPays)
+	assert.Equal(t, softDelete, *area.SoftDeleteRetention)
+
+	_, err = gcs.CreateWithOptions(ctx, "configured", nil)
+	assert.ErrorIs(t, err, ErrAlreadyExists)
+}
+
+func TestUpdateBucket(t *testing.T) {
+	ctx := cloudy.StartContext()
+	fake, gcs := startFakeStorage(t)
+	fake.createBucket(gcs, "existing")
+
+	requesterPays := true
+	noSoftDelete := time.Duration(0)
+	area, err := gcs.UpdateBucket(ctx, "existing", &BucketOptions{
+		StorageClass:        StorageClassArchive,
+		RequesterPays:       &requesterPays,
+		SoftDeleteRetention: &noSoftDelete,
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, StorageClassArchive, area.StorageClass)
+	assert.True(t, area.RequesterPays)
+	assert.False(t, area.VersioningEnabled)
+	assert.Equal(t, time.Duration(0), *area.SoftDeleteRetention)
+
+	_, err = gcs.UpdateBucket(ctx, "existing", &BucketOptions{Location: "US-EAST1"})
+	assert.NotNil(t, err)
+
+	_, err = gcs.UpdateBucket(ctx, "missing", &BucketOptions{StorageClass: StorageClassStandard})
+	assert.True(t, IsNotFound(err))
+
+	// Nothing to change
+	area, err = gcs.UpdateBucket(ctx, "existing", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, StorageClassArchive, area.StorageClass)
+}
+
+func TestCreateWithOptionsFailure(t *testing.T) {
+	ctx := cloudy.StartContext()
+	fake, gcs := startFakeStorage(t)
+
+	// The bucket is deleted again when its soft delete policy cannot be set
+	softDelete := 7 * 24 * time.Hour
+	fake.patchBucketError = 403
+	_, err := gcs.CreateWithOptions(ctx, "partial", &CreateBucketOptions{
+		BucketOptions: BucketOptions{SoftDeleteRetention: &softDelete},
+	})
+	assert.True(t, IsForbidden(err))
+	exists, err := gcs.Exists(ctx, "partial")
+	assert.Nil(t, err)
+	assert.False(t, exists)
+
+	fake.patchBucketError = 0
+	_, err = gcs.CreateWithOptions(ctx, "partial", &CreateBucketOptions{
+		BucketOptions: BucketOptions{SoftDeleteRetention: &softDelete},
+	})
+	assert.Nil(t, err)
+}
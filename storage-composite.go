@@ -0,0 +1,193 @@
+package cloudygcp
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"cloud.google.com/go/storage"
+	"github.com/appliedres/cloudy"
+	"github.com/google/uuid"
+)
+
+// MaxComposeComponents is the most source objects GCS accepts in a single compose
+const MaxComposeComponents = 32
+
+// DefaultCompositeParts is the number of parts used when CompositeUploadOptions.Parts is not set
+const DefaultCompositeParts = 8
+
+// DefaultCompositeTempPrefix is where the temporary part objects are written
+const DefaultCompositeTempPrefix = ".composite-uploads/"
+
+// CompositeUploadOptions controls UploadComposite. The tags, content type and
+// preconditions of the UploadOptions apply to the final object.
+type CompositeUploadOptions struct {
+	UploadOptions
+
+	// Number of parts the content is split into
+	Parts int
+	// Number of parts uploaded at the same time, defaults to Parts
+	Concurrency int
+	// Prefix of the temporary objects, defaults to DefaultCompositeTempPrefix
+	TempPrefix string
+}
+
+// UploadComposite performs a parallel composite upload. The content is split into parts
+// that are uploaded concurrently to temporary objects and then joined with compose. More
+// than MaxComposeComponents parts are joined in several rounds. The temporary objects are
+// removed whether the upload succeeds or not.
+//
+// Composite objects have a CRC32C checksum but no MD5 hash.
+func (gcpb *GoogleCloudStorageBucket) UploadComposite(ctx context.Context, key string, data io.ReaderAt, size int64, opts *CompositeUploadOptions) (*GoogleStoredObject, error) {
+	if opts == nil {
+		opts = &CompositeUploadOptions{}
+	}
+	if err := opts.validate(); err != nil {
+		return nil, cloudy.Error(ctx, "UploadComposite(%q): %v", key, err)
+	}
+	enc, err := gcpb.encryption(opts.Encryption)
+	if err != nil {
+		return nil, cloudy.Error(ctx, "UploadComposite(%q): %v", key, err)
+	}
+
+	parts := opts.Parts
+	if parts <= 0 {
+		parts = DefaultCompositeParts
+	}
+	if int64(parts) > size {
+		parts = int(size)
+	}
+	if parts <= 1 {
+		return gcpb.UploadWithOptions(ctx, key, io.NewSectionReader(data, 0, size), &opts.UploadOptions)
+	}
+
+	concurrency := opts.Concurrency
+	if concurrency <= 0 {
+		concurrency = parts
+	}
+	prefix := opts.TempPrefix
+	if prefix == "" {
+		prefix = DefaultCompositeTempPrefix
+	}
+
+	c := &compositeUpload{
+		bucket:     gcpb,
+		prefix:     fmt.Sprintf("%v%v/", prefix, uuid.NewString()),
+		encryption: enc,
+	}
+	defer c.cleanup(ctx)
+
+	names := make([]string, parts)
+	for i := range names {
+		names[i] = c.tempName()
+	}
+
+	partSize := size / int64(parts)
+	err = runParallel(ctx, parts, concurrency, func(ctx context.Context, i int) error {
+		offset := int64(i) * partSize
+		length := partSize
+		if i == parts-1 {
+			length = size - offset
+		}
+
+		_, err := gcpb.UploadWithOptions(ctx, names[i], io.NewSectionReader(data, offset, length), &UploadOptions{
+			ChunkSize:  opts.ChunkSize,
+			Encryption: enc,
+		})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	attrs, err := c.compose(ctx, names, key, &opts.UploadOptions)
+	if err != nil {
+		return nil, err
+	}
+	return toStoredObject(attrs), nil
+}
+
+// compositeUpload tracks the temporary objects of a composite upload. Every part is
+// encrypted with the key of the final object, as compose requires.
+type compositeUpload struct {
+	bucket     *GoogleCloudStorageBucket
+	prefix     string
+	temp       []string
+	encryption *ObjectEncryption
+}
+
+func (c *compositeUpload) tempName() string {
+	name := fmt.Sprintf("%v%05d", c.prefix, len(c.temp))
+	c.temp = append(c.temp, name)
+	return name
+}
+
+// compose joins the sources into the destination, composing groups of
+// MaxComposeComponents into temporary objects until a single compose is enough
+func (c *compositeUpload) compose(ctx context.Context, sources []string, key string, opts *UploadOptions) (*storage.ObjectAttrs, error) {
+	bkt := c.bucket.Client.Bucket(c.bucket.Bucket)
+
+	for len(sources) > MaxComposeComponents {
+		var next []string
+		for start := 0; start < len(sources); start += MaxComposeComponents {
+			end := start + MaxComposeComponents
+			if end > len(sources) {
+				end = len(sources)
+			}
+			if end-start == 1 {
+				next = append(next, sources[start])
+				continue
+			}
+
+			name := c.tempName()
+			if _, err := c.run(ctx, c.encryption.apply(bkt.Object(name)), sources[start:end], nil); err != nil {
+				return nil, err
+			}
+			next = append(next, name)
+		}
+		sources = next
+	}
+
+	dst := c.encryption.apply(bkt.Object(key))
+	if conds, ok := opts.conditions(); ok {
+		dst = dst.If(conds)
+	}
+	return c.run(ctx, dst, sources, opts)
+}
+
+func (c *compositeUpload) run(ctx context.Context, dst *storage.ObjectHandle, sources []string, opts *UploadOptions) (*storage.ObjectAttrs, error) {
+	bkt := c.bucket.Client.Bucket(c.bucket.Bucket)
+	srcs := make([]*storage.ObjectHandle, len(sources))
+	for i, name := range sources {
+		srcs[i] = bkt.Object(name)
+	}
+
+	composer := dst.ComposerFrom(srcs...)
+	composer.KMSKeyName = c.encryption.kmsKeyName()
+	if opts != nil {
+		composer.ContentType = opts.ContentType
+		composer.Metadata = prepareTags(ctx, opts.Tags)
+	}
+
+	attrs, err := composer.Run(ctx)
+	if err != nil {
+		return nil, classifyStorageError(fmt.Errorf("Object(%q).Compose: %w", dst.ObjectName(), err))
+	}
+	return attrs, nil
+}
+
+// cleanup removes all the temporary objects, even if the upload was cancelled
+func (c *compositeUpload) cleanup(ctx context.Context) {
+	if ctx.Err() != nil {
+		ctx = context.Background()
+	}
+
+	bkt := c.bucket.Client.Bucket(c.bucket.Bucket)
+	_ = runParallel(ctx, len(c.temp), MaxComposeComponents, func(ctx context.Context, i int) error {
+		err := bkt.Object(c.temp[i]).Delete(ctx)
+		if err != nil && !IsNotFound(err) {
+			cloudy.Error(ctx, "Unable to remove temporary object %v, %v", c.temp[i], err)
+		}
+		return nil
+	})
+}
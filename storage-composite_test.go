@@ -0,0 +1,65 @@
+package cloudygcp
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+
+	"github.com/appliedres/cloudy"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUploadComposite(t *testing.T) {
+	ctx := cloudy.StartContext()
+	fake, gcs := startFakeStorage(t)
+	bucket := fake.createBucket(gcs, "composite")
+	data := testData(40*1024 + 17)
+
+	obj, err := bucket.UploadComposite(ctx, "big.bin", bytes.NewReader(data), int64(len(data)), &CompositeUploadOptions{
+		UploadOptions: UploadOptions{
+			Tags:        map[string]string{"owner": "tester"},
+			ContentType: "application/x-test",
+		},
+		Parts:       40,
+		Concurrency: 4,
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(data)), obj.Size)
+	assert.Equal(t, "tester", obj.Tags["owner"])
+	assert.Equal(t, "application/x-test", obj.ContentType)
+	assert.Equal(t, data, fake.object("composite", "big.bin").data)
+
+	// 40 parts need two intermediate composes before the final one
+	assert.Equal(t, MaxComposeComponents, fake.maxComposeSources)
+	assert.Equal(t, 3, fake.requestCount(http.MethodPost, "/storage/v1/b/composite/o/"))
+
+	// Only the final object is left
+	assert.Equal(t, []string{"big.bin"}, fake.objectNames("composite"))
+}
+
+func TestUploadCompositeFailure(t *testing.T) {
+	ctx := cloudy.StartContext()
+	fake, gcs := startFakeStorage(t)
+	bucket := fake.createBucket(gcs, "composite")
+	data := testData(8 * 1024)
+
+	fake.composeError = http.StatusForbidden
+	_, err := bucket.UploadComposite(ctx, "big.bin", bytes.NewReader(data), int64(len(data)), &CompositeUploadOptions{
+		Parts: 4,
+	})
+	assert.True(t, IsForbidden(err))
+
+	// The parts are removed when the compose fails
+	assert.Empty(t, fake.objectNames("composite"))
+}
+
+func TestUploadCompositeSmall(t *testing.T) {
+	ctx := cloudy.StartContext()
+	fake, gcs := startFakeStorage(t)
+	bucket := fake.createBucket(gcs, "composite")
+
+	_, err := bucket.UploadComposite(ctx, "tiny.txt", bytes.NewReader([]byte("a")), 1, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("a"), fake.object("composite", "tiny.txt").data)
+	assert.Equal(t, 0, fake.maxComposeSources)
+}
@@ -0,0 +1,177 @@
+package cloudygcp
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"github.com/appliedres/cloudy"
+	cloudystorage "github.com/appliedres/cloudy/storage"
+)
+
+// DefaultRenameConcurrency is the number of objects RenamePrefix moves at once
+const DefaultRenameConcurrency = 16
+
+// CopyOptions controls Copy and Move. The tags and content type of the source are kept
+// unless they are overridden.
+type CopyOptions struct {
+	// Bucket of the destination, defaults to the bucket of the source
+	DestinationBucket string
+	ContentType       string
+	Tags              map[string]string
+
+	// Only copy if the destination does not exist
+	DoesNotExist bool
+	// Only copy if the live generation of the destination matches
+	GenerationMatch int64
+	// Copy this generation of the source instead of the live one
+	SourceGeneration int64
+
+	// Encryption of the destination, defaults to the encryption of the bucket handle. The
+	// source is read with the encryption of the handle, so copying to a different key
+	// rotates the key of the object.
+	Encryption *ObjectEncryption
+
+	// Token of an interrupted copy to continue, see Progress
+	RewriteToken string
+	// Called after each rewrite request. Copies between locations or storage classes can
+	// take many requests, the token is set until the copy completes and can be persisted
+	// and passed back as RewriteToken to resume.
+	Progress func(copied int64, total int64, rewriteToken string)
+}
+
+// RenameOptions controls RenamePrefix
+type RenameOptions struct {
+	// Bucket the objects are moved to, defaults to the bucket of the source
+	DestinationBucket string
+	// Number of objects moved at the same time, defaults to DefaultRenameConcurrency
+	Concurrency int
+	// Fail instead of overwriting existing destination objects
+	DoesNotExist bool
+}
+
+// Copy copies the object server side, the data never goes through this process
+func (gcpb *GoogleCloudStorageBucket) Copy(ctx context.Context, srcKey string, dstKey string, opts *CopyOptions) (*GoogleStoredObject, error) {
+	if opts == nil {
+		opts = &CopyOptions{}
+	}
+	src := gcpb.object(srcKey)
+	if opts.SourceGeneration != 0 {
+		src = src.Generation(opts.SourceGeneration)
+	}
+	return gcpb.copy(ctx, src, dstKey, opts)
+}
+
+// Move copies the object and then deletes the source. The source is only deleted if it
+// was not overwritten while it was being copied.
+func (gcpb *GoogleCloudStorageBucket) Move(ctx context.Context, srcKey string, dstKey string, opts *CopyOptions) (*GoogleStoredObject, error) {
+	if opts == nil {
+		opts = &CopyOptions{}
+	}
+	src := gcpb.object(srcKey)
+
+	generation := opts.SourceGeneration
+	if generation == 0 {
+		attrs, err := src.Attrs(ctx)
+		if err != nil {
+			return nil, classifyStorageError(fmt.Errorf("Object(%q).Attrs: %w", srcKey, err))
+		}
+		generation = attrs.Generation
+	}
+
+	obj, err := gcpb.copy(ctx, src.Generation(generation), dstKey, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	err = src.If(storage.Conditions{GenerationMatch: generation}).Delete(ctx)
+	if err != nil {
+		return obj, classifyStorageError(fmt.Errorf("Object(%q).Delete: %w", srcKey, err))
+	}
+	return obj, nil
+}
+
+// RenamePrefix moves every object under fromPrefix to the same key under toPrefix. The
+// objects are moved concurrently and the first failure stops the rename, the objects
+// already moved stay at their new keys. Returns the number of objects moved.
+func (gcpb *GoogleCloudStorageBucket) RenamePrefix(ctx context.Context, fromPrefix string, toPrefix string, opts *RenameOptions) (int, error) {
+	if opts == nil {
+		opts = &RenameOptions{}
+	}
+	concurrency := opts.Concurrency
+	if concurrency <= 0 {
+		concurrency = DefaultRenameConcurrency
+	}
+
+	var objects []*GoogleStoredObject
+	err := gcpb.ListEach(ctx, &ListOptions{Prefix: fromPrefix, Recursive: true}, func(obj *GoogleStoredObject, _ *cloudystorage.StoredPrefix) error {
+		objects = append(objects, obj)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	moved := make([]bool, len(objects))
+	err = runParallel(ctx, len(objects), concurrency, func(ctx context.Context, i int) error {
+		obj := objects[i]
+		_, err := gcpb.Move(ctx, obj.Key, toPrefix+strings.TrimPrefix(obj.Key, fromPrefix), &CopyOptions{
+			DestinationBucket: opts.DestinationBucket,
+			DoesNotExist:      opts.DoesNotExist,
+			SourceGeneration:  obj.Generation,
+		})
+		moved[i] = err == nil
+		return err
+	})
+
+	count := 0
+	for _, m := range moved {
+		if m {
+			count++
+		}
+	}
+	return count, err
+}
+
+func (gcpb *GoogleCloudStorageBucket) copy(ctx context.Context, src *storage.ObjectHandle, dstKey string, opts *CopyOptions) (*GoogleStoredObject, error) {
+	// The preconditions of the destination are those of an upload
+	preconditions := &UploadOptions{DoesNotExist: opts.DoesNotExist, GenerationMatch: opts.GenerationMatch}
+	if err := preconditions.validate(); err != nil {
+		return nil, cloudy.Error(ctx, "Copy(%q): %v", dstKey, err)
+	}
+
+	dstBucket := opts.DestinationBucket
+	if dstBucket == "" {
+		dstBucket = gcpb.Bucket
+	}
+	enc, err := gcpb.encryption(opts.Encryption)
+	if err != nil {
+		return nil, cloudy.Error(ctx, "Copy(%q): %v", dstKey, err)
+	}
+	dst := enc.apply(gcpb.Client.Bucket(dstBucket).Object(dstKey))
+	if opts.DoesNotExist {
+		dst = dst.If(storage.Conditions{DoesNotExist: true})
+	} else if opts.GenerationMatch != 0 {
+		dst = dst.If(storage.Conditions{GenerationMatch: opts.GenerationMatch})
+	}
+
+	copier := dst.CopierFrom(src)
+	copier.ContentType = opts.ContentType
+	copier.RewriteToken = opts.RewriteToken
+	copier.DestinationKMSKeyName = enc.kmsKeyName()
+	if opts.Tags != nil {
+		copier.Metadata = prepareTags(ctx, opts.Tags)
+	}
+	if opts.Progress != nil {
+		copier.ProgressFunc = func(copied uint64, total uint64) {
+			opts.Progress(int64(copied), int64(total), copier.RewriteToken)
+		}
+	}
+
+	attrs, err := copier.Run(ctx)
+	if err != nil {
+		return nil, classifyStorageError(fmt.Errorf("Object(%q).CopierFrom(%q): %w", dstKey, src.ObjectName(), err))
+	}
+	return toStoredObject(attrs), nil
+}
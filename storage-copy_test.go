@@ -0,0 +1,91 @@
+package cloudygcp
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/appliedres/cloudy"
+	"github.com/stretchr/testify/assert"
+)
+
+func readObject(t *testing.T, bucket *GoogleCloudStorageBucket, key string) string {
+	reader, err := bucket.Download(cloudy.StartContext(), key)
+	if !assert.Nil(t, err) {
+		return ""
+	}
+	defer reader.Close()
+	data, _ := io.ReadAll(reader)
+	return string(data)
+}
+
+func TestCopy(t *testing.T) {
+	ctx := cloudy.StartContext()
+	fake, gcs := startFakeStorage(t)
+	bucket := fake.createBucket(gcs, "source")
+	fake.createBucket(gcs, "archive")
+
+	_, err := bucket.UploadWithOptions(ctx, "report.csv", bytes.NewReader([]byte("a,b,c")), &UploadOptions{
+		ContentType: "text/csv",
+		Tags:        map[string]string{"owner": "finance"},
+	})
+	assert.Nil(t, err)
+
+	obj, err := bucket.Copy(ctx, "report.csv", "report-copy.csv", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "text/csv", obj.ContentType)
+	assert.Equal(t, "finance", obj.Tags["owner"])
+	assert.Equal(t, "a,b,c", readObject(t, bucket, "report-copy.csv"))
+
+	_, err = bucket.Copy(ctx, "report.csv", "report-copy.csv", &CopyOptions{DoesNotExist: true})
+	assert.True(t, IsPreconditionFailed(err))
+
+	// Large copies across buckets take several rewrite requests
+	fake.rewriteChunk = 2
+	var tokens []string
+	obj, err = bucket.Copy(ctx, "report.csv", "2023/report.csv", &CopyOptions{
+		DestinationBucket: "archive",
+		Tags:              map[string]string{"owner": "audit"},
+		Progress: func(copied int64, total int64, rewriteToken string) {
+			assert.Equal(t, int64(5), total)
+			tokens = append(tokens, rewriteToken)
+		},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"2", "4", ""}, tokens)
+	assert.Equal(t, "audit", obj.Tags["owner"])
+	assert.Equal(t, "a,b,c", readObject(t, gcs.bucket("archive"), "2023/report.csv"))
+
+	// An interrupted copy resumes from its token
+	before := fake.requestCount("POST", "/storage/v1/b/source/o/report.csv/rewriteTo")
+	_, err = bucket.Copy(ctx, "report.csv", "resumed.csv", &CopyOptions{RewriteToken: "4"})
+	assert.Nil(t, err)
+	assert.Equal(t, before+1, fake.requestCount("POST", "/storage/v1/b/source/o/report.csv/rewriteTo"))
+
+	_, err = bucket.Copy(ctx, "missing.csv", "other.csv", nil)
+	assert.True(t, IsNotFound(err))
+}
+
+func TestMoveAndRenamePrefix(t *testing.T) {
+	ctx := cloudy.StartContext()
+	fake, gcs := startFakeStorage(t)
+	bucket := fake.createBucket(gcs, "moves")
+	uploadKeys(t, bucket, "inbox/a.txt", "inbox/b.txt", "inbox/sub/c.txt", "inboxed.txt")
+
+	obj, err := bucket.Move(ctx, "inboxed.txt", "done/inboxed.txt", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "done/inboxed.txt", obj.Key)
+	assert.Nil(t, fake.object("moves", "inboxed.txt"))
+
+	moved, err := bucket.RenamePrefix(ctx, "inbox/", "processed/", &RenameOptions{Concurrency: 2})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, moved)
+	assert.Equal(t, []string{"done/inboxed.txt", "processed/a.txt", "processed/b.txt", "processed/sub/c.txt"}, fake.objectNames("moves"))
+	assert.Equal(t, "inbox/sub/c.txt", readObject(t, bucket, "processed/sub/c.txt"))
+
+	// Existing destinations are not overwritten
+	uploadKeys(t, bucket, "inbox/a.txt", "inbox/d.txt")
+	_, err = bucket.RenamePrefix(ctx, "inbox/", "processed/", &RenameOptions{DoesNotExist: true, Concurrency: 1})
+	assert.True(t, IsPreconditionFailed(err))
+	assert.NotNil(t, fake.object("moves", "inbox/a.txt"))
+}
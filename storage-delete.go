@@ -0,0 +1,191 @@
+package cloudygcp
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+// DefaultDeleteConcurrency is the number of objects deleted at once by DeletePrefix and
+// ForceDelete
+const DefaultDeleteConcurrency = 32
+
+// DeleteOptions controls DeletePrefix and ForceDelete
+type DeleteOptions struct {
+	// Only return the keys that would be deleted
+	DryRun bool
+	// Number of objects deleted at the same time, defaults to DefaultDeleteConcurrency
+	Concurrency int
+}
+
+func (opts *DeleteOptions) concurrency() int {
+	if opts.Concurrency <= 0 {
+		return DefaultDeleteConcurrency
+	}
+	return opts.Concurrency
+}
+
+// DeletePrefix deletes every object under the prefix and returns their keys. In versioned
+// buckets the objects become noncurrent. An empty prefix deletes every object of the bucket.
+// Objects overwritten during the deletion are kept and reported as ErrPreconditionFailed.
+// The objects are deleted while they are listed, on error the keys deleted so far are
+// returned along with it.
+func (gcpb *GoogleCloudStorageBucket) DeletePrefix(ctx context.Context, prefix string, opts *DeleteOptions) ([]string, error) {
+	if opts == nil {
+		opts = &DeleteOptions{}
+	}
+	q := &storage.Query{Prefix: prefix}
+	if opts.DryRun {
+		return gcpb.listKeys(ctx, q)
+	}
+
+	bkt := gcpb.Client.Bucket(gcpb.Bucket)
+	return gcpb.deleteEach(ctx, q, opts.concurrency(), func(ctx context.Context, attrs *storage.ObjectAttrs) error {
+		o := bkt.Object(attrs.Name).If(storage.Conditions{GenerationMatch: attrs.Generation})
+		return ignoreNotFound(o.Delete(ctx), attrs.Name)
+	})
+}
+
+// ForceDelete empties the bucket, including the noncurrent generations of versioned
+// buckets, and then deletes it. Returns the keys of the objects that were deleted, also
+// when the deletion fails part way. Objects under a retention policy or hold cannot be
+// deleted and make the deletion fail.
+func (gcps *GoogleCloudStorage) ForceDelete(ctx context.Context, key string, opts *DeleteOptions) ([]string, error) {
+	if opts == nil {
+		opts = &DeleteOptions{}
+	}
+	gcpb := gcps.bucket(key)
+	q := &storage.Query{Versions: true}
+	if opts.DryRun {
+		return gcpb.listKeys(ctx, q)
+	}
+
+	bkt := gcps.Client.Bucket(key)
+	keys, err := gcpb.deleteEach(ctx, q, opts.concurrency(), func(ctx context.Context, attrs *storage.ObjectAttrs) error {
+		o := bkt.Object(attrs.Name).Generation(attrs.Generation)
+		return ignoreNotFound(o.Delete(ctx), attrs.Name)
+	})
+	if err != nil {
+		return keys, err
+	}
+
+	if err = bkt.Delete(ctx); err != nil {
+		return keys, classifyStorageError(fmt.Errorf("Bucket(%q).Delete: %w", key, err))
+	}
+	return keys, nil
+}
+
+// generations lists the name and generation of the objects matching the query
+func (gcpb *GoogleCloudStorageBucket) generations(ctx context.Context, q *storage.Query) (*storage.ObjectIterator, error) {
+	if err := q.SetAttrSelection([]string{"Name", "Generation"}); err != nil {
+		return nil, err
+	}
+	return gcpb.Client.Bucket(gcpb.Bucket).Objects(ctx, q), nil
+}
+
+// listKeys returns the names of the objects matching the query. They are listed in name
+// order so the generations of an object are next to each other.
+func (gcpb *GoogleCloudStorageBucket) listKeys(ctx context.Context, q *storage.Query) ([]string, error) {
+	it, err := gcpb.generations(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	keys := []string{}
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			return keys, nil
+		}
+		if err != nil {
+			return nil, classifyStorageError(fmt.Errorf("Bucket(%q).Objects(): %w", gcpb.Bucket, err))
+		}
+		if len(keys) == 0 || keys[len(keys)-1] != attrs.Name {
+			keys = append(keys, attrs.Name)
+		}
+	}
+}
+
+// deleteEach calls del for each object generation matching the query, using at most
+// concurrency goroutines while the following pages are listed. The listing stops at the
+// first failure. Returns the sorted keys of the objects with a deleted generation, along
+// with the first error.
+func (gcpb *GoogleCloudStorageBucket) deleteEach(ctx context.Context, q *storage.Query, concurrency int, del func(ctx context.Context, attrs *storage.ObjectAttrs) error) ([]string, error) {
+	it, err := gcpb.generations(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var firstErr error
+	deleted := make(map[string]bool)
+	fail := func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if firstErr == nil {
+			firstErr = err
+			cancel()
+		}
+	}
+	sem := make(chan struct{}, concurrency)
+
+	for ctx.Err() == nil {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			fail(classifyStorageError(fmt.Errorf("Bucket(%q).Objects(): %w", gcpb.Bucket, err)))
+			break
+		}
+
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		wg.Add(1)
+		go func(attrs *storage.ObjectAttrs) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if err := del(ctx, attrs); err != nil {
+				fail(err)
+				return
+			}
+			mu.Lock()
+			deleted[attrs.Name] = true
+			mu.Unlock()
+		}(attrs)
+	}
+	wg.Wait()
+
+	keys := make([]string, 0, len(deleted))
+	for k := range deleted {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	if firstErr == nil && ctx.Err() != nil {
+		// The parent context was cancelled
+		return keys, ctx.Err()
+	}
+	return keys, firstErr
+}
+
+// ignoreNotFound drops the error of an object that was already deleted
+func ignoreNotFound(err error, key string) error {
+	if err == nil || IsNotFound(err) {
+		return nil
+	}
+	return classifyStorageError(fmt.Errorf("Object(%q).Delete: %w", key, err))
+}
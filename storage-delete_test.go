@@ -0,0 +1,82 @@
+package cloudygcp
+
+import (
+	"testing"
+
+	"github.com/appliedres/cloudy"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeletePrefix(t *testing.T) {
+	ctx := cloudy.StartContext()
+	fake, gcs := startFakeStorage(t)
+	bucket := fake.createBucket(gcs, "cleanup")
+	uploadKeys(t, bucket, "logs/1.txt", "logs/2.txt", "logs/old/3.txt", "logsheet.txt", "keep.txt")
+
+	keys, err := bucket.DeletePrefix(ctx, "logs/", &DeleteOptions{DryRun: true})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"logs/1.txt", "logs/2.txt", "logs/old/3.txt"}, keys)
+	assert.Len(t, fake.objectNames("cleanup"), 5)
+
+	keys, err = bucket.DeletePrefix(ctx, "logs/", &DeleteOptions{Concurrency: 2})
+	assert.Nil(t, err)
+	assert.Len(t, keys, 3)
+	assert.Equal(t, []string{"keep.txt", "logsheet.txt"}, fake.objectNames("cleanup"))
+
+	keys, err = bucket.DeletePrefix(ctx, "logs/", nil)
+	assert.Nil(t, err)
+	assert.Empty(t, keys)
+}
+
+func TestDeletePrefixFailure(t *testing.T) {
+	ctx := cloudy.StartContext()
+	fake, gcs := startFakeStorage(t)
+	bucket := fake.createBucket(gcs, "cleanup")
+	uploadKeys(t, bucket, "logs/1.txt", "logs/2.txt", "logs/3.txt")
+
+	// The keys deleted before the failure are reported with it
+	fake.deleteErrors = map[string]int{"logs/2.txt": 403}
+	keys, err := bucket.DeletePrefix(ctx, "logs/", &DeleteOptions{Concurrency: 1})
+	assert.True(t, IsForbidden(err))
+	assert.Equal(t, []string{"logs/1.txt"}, keys)
+	assert.Equal(t, []string{"logs/2.txt", "logs/3.txt"}, fake.objectNames("cleanup"))
+
+	keys, err = gcs.ForceDelete(ctx, "cleanup", &DeleteOptions{Concurrency: 1})
+	assert.True(t, IsForbidden(err))
+	assert.Empty(t, keys)
+	exists, _ := gcs.Exists(ctx, "cleanup")
+	assert.True(t, exists)
+}
+
+func TestForceDelete(t *testing.T) {
+	ctx := cloudy.StartContext()
+	fake, gcs := startFakeStorage(t)
+	bucket := fake.createBucket(gcs, "doomed")
+
+	versioning := true
+	_, err := gcs.UpdateBucket(ctx, "doomed", &BucketOptions{Versioning: &versioning})
+	assert.Nil(t, err)
+	uploadKeys(t, bucket, "a.txt", "a.txt", "b/c.txt", "d.txt")
+	err = bucket.Delete(ctx, "d.txt")
+	assert.Nil(t, err)
+
+	// A plain delete fails on a bucket that is not empty
+	err = gcs.Delete(ctx, "doomed")
+	assert.NotNil(t, err)
+
+	keys, err := gcs.ForceDelete(ctx, "doomed", &DeleteOptions{DryRun: true})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"a.txt", "b/c.txt", "d.txt"}, keys)
+	exists, _ := gcs.Exists(ctx, "doomed")
+	assert.True(t, exists)
+
+	keys, err = gcs.ForceDelete(ctx, "doomed", nil)
+	assert.Nil(t, err)
+	assert.Len(t, keys, 3)
+	exists, err = gcs.Exists(ctx, "doomed")
+	assert.Nil(t, err)
+	assert.False(t, exists)
+
+	_, err = gcs.ForceDelete(ctx, "doomed", nil)
+	assert.True(t, IsNotFound(err))
+}
@@ -0,0 +1,193 @@
+package cloudygcp
+
+import (
+	"context"
+	"fmt"
+	"hash/crc32"
+	"io"
+
+	"github.com/appliedres/cloudy"
+)
+
+// DefaultDownloadSliceSize is the size of each range read by DownloadParallel
+const DefaultDownloadSliceSize = 32 * 1024 * 1024
+
+// DefaultDownloadConcurrency is the number of range reads DownloadParallel runs at once
+const DefaultDownloadConcurrency = 8
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// ParallelDownloadOptions controls DownloadParallel
+type ParallelDownloadOptions struct {
+	// Size of each range read, defaults to DefaultDownloadSliceSize
+	SliceSize int64
+	// Number of slices read at the same time, defaults to DefaultDownloadConcurrency
+	Concurrency int
+}
+
+// DownloadRange opens a reader for length bytes of the object starting at offset. A
+// negative length reads to the end of the object and a negative offset reads the
+// last -offset bytes.
+func (gcpb *GoogleCloudStorageBucket) DownloadRange(ctx context.Context, key string, offset int64, length int64) (io.ReadCloser, error) {
+	o := gcpb.object(key)
+	reader, err := o.NewRangeReader(ctx, offset, length)
+	if err != nil {
+		return nil, classifyStorageError(fmt.Errorf("Object(%q).NewRangeReader: %w", key, err))
+	}
+	return reader, nil
+}
+
+// DownloadParallel downloads the object into w using concurrent range reads. All of the
+// slices are read from the same generation and the CRC32C of the content is checked
+// against the object attributes, a mismatch is reported as ErrChecksumMismatch.
+func (gcpb *GoogleCloudStorageBucket) DownloadParallel(ctx context.Context, key string, w io.WriterAt, opts *ParallelDownloadOptions) (*GoogleStoredObject, error) {
+	if opts == nil {
+		opts = &ParallelDownloadOptions{}
+	}
+	sliceSize := opts.SliceSize
+	if sliceSize <= 0 {
+		sliceSize = DefaultDownloadSliceSize
+	}
+	concurrency := opts.Concurrency
+	if concurrency <= 0 {
+		concurrency = DefaultDownloadConcurrency
+	}
+
+	o := gcpb.object(key)
+	attrs, err := o.Attrs(ctx)
+	if err != nil {
+		return nil, classifyStorageError(fmt.Errorf("Object(%q).Attrs: %w", key, err))
+	}
+	o = o.Generation(attrs.Generation)
+
+	slices := int((attrs.Size + sliceSize - 1) / sliceSize)
+	checksums := make([]uint32, slices)
+
+	err = runParallel(ctx, slices, concurrency, func(ctx context.Context, i int) error {
+		offset := int64(i) * sliceSize
+		length := sliceSize
+		if offset+length > attrs.Size {
+			length = attrs.Size - offset
+		}
+
+		reader, err := o.NewRangeReader(ctx, offset, length)
+		if err != nil {
+			return classifyStorageError(fmt.Errorf("Object(%q).NewRangeReader: %w", key, err))
+		}
+		defer reader.Close()
+
+		crc, n, err := copyAt(w, reader, offset)
+		if err != nil {
+			return classifyStorageError(fmt.Errorf("Object(%q) range %v-%v: %w", key, offset, offset+length-1, err))
+		}
+		if n != length {
+			return cloudy.Error(ctx, "Object(%q) range %v-%v: read %v bytes", key, offset, offset+length-1, n)
+		}
+		checksums[i] = crc
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var crc uint32
+	for i, sum := range checksums {
+		length := sliceSize
+		if i == slices-1 {
+			length = attrs.Size - int64(i)*sliceSize
+		}
+		crc = crc32Combine(crc32.Castagnoli, crc, sum, length)
+	}
+	if crc != attrs.CRC32C {
+		return nil, newGcpError(ErrChecksumMismatch, fmt.Errorf("Object(%q): CRC32C is %08x, expected %08x", key, crc, attrs.CRC32C))
+	}
+
+	return toStoredObject(attrs), nil
+}
+
+// copyAt copies the reader into w starting at offset, returning the CRC32C and size of
+// what was copied
+func copyAt(w io.WriterAt, r io.Reader, offset int64) (uint32, int64, error) {
+	buf := make([]byte, 256*1024)
+	var crc uint32
+	var written int64
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			crc = crc32.Update(crc, castagnoli, buf[:n])
+			if _, werr := w.WriteAt(buf[:n], offset+written); werr != nil {
+				return crc, written, werr
+			}
+			written += int64(n)
+		}
+		if err == io.EOF {
+			return crc, written, nil
+		}
+		if err != nil {
+			return crc, written, err
+		}
+	}
+}
+
+// crc32Combine returns the CRC of two blocks of data given the CRC of each block and the
+// length of the second one. This is the GF(2) matrix method used by zlib's crc32_combine,
+// for any (reversed) polynomial.
+func crc32Combine(poly uint32, crc1 uint32, crc2 uint32, len2 int64) uint32 {
+	if len2 <= 0 {
+		return crc1 ^ crc2
+	}
+
+	even := make([]uint32, 32)
+	odd := make([]uint32, 32)
+
+	// Operator for one zero bit
+	odd[0] = poly
+	row := uint32(1)
+	for n := 1; n < 32; n++ {
+		odd[n] = row
+		row <<= 1
+	}
+
+	// Operators for two and four zero bits
+	gf2MatrixSquare(even, odd)
+	gf2MatrixSquare(odd, even)
+
+	// Apply len2 zero bytes to crc1
+	for {
+		gf2MatrixSquare(even, odd)
+		if len2&1 != 0 {
+			crc1 = gf2MatrixTimes(even, crc1)
+		}
+		len2 >>= 1
+		if len2 == 0 {
+			break
+		}
+
+		gf2MatrixSquare(odd, even)
+		if len2&1 != 0 {
+			crc1 = gf2MatrixTimes(odd, crc1)
+		}
+		len2 >>= 1
+		if len2 == 0 {
+			break
+		}
+	}
+	return crc1 ^ crc2
+}
+
+func gf2MatrixTimes(mat []uint32, vec uint32) uint32 {
+	var sum uint32
+	for i := 0; vec != 0; i++ {
+		if vec&1 != 0 {
+			sum ^= mat[i]
+		}
+		vec >>= 1
+	}
+	return sum
+}
+
+func gf2MatrixSquare(square []uint32, mat []uint32) {
+	for n := 0; n < 32; n++ {
+		square[n] = gf2MatrixTimes(mat, mat[n])
+	}
+}
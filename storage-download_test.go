@@ -0,0 +1,87 @@
+package cloudygcp
+
+import (
+	"bytes"
+	"errors"
+	"hash/crc32"
+	"io"
+	"sync"
+	"testing"
+
+	"github.com/appliedres/cloudy"
+	"github.com/stretchr/testify/assert"
+)
+
+// memoryWriterAt collects the output of a parallel download
+type memoryWriterAt struct {
+	mu   sync.Mutex
+	data []byte
+}
+
+func (m *memoryWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if end := int(off) + len(p); end > len(m.data) {
+		m.data = append(m.data, make([]byte, end-len(m.data))...)
+	}
+	copy(m.data[off:], p)
+	return len(p), nil
+}
+
+func TestCrc32Combine(t *testing.T) {
+	data := testData(10000)
+	for _, split := range []int{0, 1, 4096, 9999, 10000} {
+		crc1 := crc32.Checksum(data[:split], castagnoli)
+		crc2 := crc32.Checksum(data[split:], castagnoli)
+		combined := crc32Combine(crc32.Castagnoli, crc1, crc2, int64(len(data)-split))
+		assert.Equal(t, crc32.Checksum(data, castagnoli), combined, "split %v", split)
+	}
+}
+
+func TestDownloadRange(t *testing.T) {
+	ctx := cloudy.StartContext()
+	fake, gcs := startFakeStorage(t)
+	bucket := fake.createBucket(gcs, "downloads")
+	data := testData(1000)
+	assert.Nil(t, bucket.Upload(ctx, "archive.bin", bytes.NewReader(data), nil))
+
+	read := func(offset int64, length int64) []byte {
+		reader, err := bucket.DownloadRange(ctx, "archive.bin", offset, length)
+		assert.Nil(t, err)
+		defer reader.Close()
+		out, err := io.ReadAll(reader)
+		assert.Nil(t, err)
+		return out
+	}
+
+	assert.Equal(t, data[100:150], read(100, 50))
+	assert.Equal(t, data[900:], read(900, -1))
+	assert.Equal(t, data[990:], read(-10, -1))
+
+	_, err := bucket.DownloadRange(ctx, "missing.bin", 0, 10)
+	assert.True(t, IsNotFound(err))
+}
+
+func TestDownloadParallel(t *testing.T) {
+	ctx := cloudy.StartContext()
+	fake, gcs := startFakeStorage(t)
+	bucket := fake.createBucket(gcs, "downloads")
+	data := testData(100*1024 + 3)
+	assert.Nil(t, bucket.Upload(ctx, "large.bin", bytes.NewReader(data), nil))
+
+	out := &memoryWriterAt{}
+	obj, err := bucket.DownloadParallel(ctx, "large.bin", out, &ParallelDownloadOptions{
+		SliceSize:   7 * 1024,
+		Concurrency: 4,
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(data)), obj.Size)
+	assert.Equal(t, data, out.data)
+
+	// A corrupted slice is detected
+	fake.corruptOffset = 14 * 1024
+	_, err = bucket.DownloadParallel(ctx, "large.bin", &memoryWriterAt{}, &ParallelDownloadOptions{
+		SliceSize: 7 * 1024,
+	})
+	assert.True(t, errors.Is(err, ErrChecksumMismatch))
+}
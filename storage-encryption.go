@@ -0,0 +1,108 @@
+package cloudygcp
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+
+	"cloud.google.com/go/storage"
+	"github.com/appliedres/cloudy"
+)
+
+// CustomerKeySize is the size of a customer-supplied AES-256 key
+const CustomerKeySize = 32
+
+// ObjectEncryption selects the key objects are encrypted with. Set at most one field,
+// when neither is set the bucket default (Google managed or the bucket CMEK key) is used.
+type ObjectEncryption struct {
+	// Customer-supplied AES-256 key (CSEK). GCS only keeps a hash of it, the same key is
+	// needed to read the object and a wrong key fails with ErrEncryptionKey.
+	Key []byte
+	// Cloud KMS key that encrypts new objects (CMEK), reads need no key
+	KMSKeyName string
+}
+
+// EncryptionKeyFromSecret reads a customer-supplied key from Secret Manager. The secret
+// holds the 32 byte key, either raw or base64 encoded.
+func EncryptionKeyFromSecret(ctx context.Context, sm *SecretManager, name string) (*ObjectEncryption, error) {
+	data, err := sm.GetSecretBinary(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if data == nil {
+		return nil, newGcpError(cloudy.ErrKeyNotFound, fmt.Errorf("encryption key secret %v not found", name))
+	}
+
+	key := data
+	if len(key) != CustomerKeySize {
+		key, err = base64.StdEncoding.DecodeString(string(data))
+		if err != nil || len(key) != CustomerKeySize {
+			return nil, cloudy.Error(ctx, "Secret %v is not a %v byte encryption key", name, CustomerKeySize)
+		}
+	}
+	return &ObjectEncryption{Key: key}, nil
+}
+
+func (enc *ObjectEncryption) validate() error {
+	if enc == nil {
+		return nil
+	}
+	if len(enc.Key) > 0 && enc.KMSKeyName != "" {
+		return fmt.Errorf("a customer-supplied key and a KMS key cannot be combined")
+	}
+	if len(enc.Key) > 0 && len(enc.Key) != CustomerKeySize {
+		return fmt.Errorf("customer-supplied keys must be %v bytes, got %v", CustomerKeySize, len(enc.Key))
+	}
+	return nil
+}
+
+// apply sets the customer-supplied key on the handle, KMS keys are set on the writers
+func (enc *ObjectEncryption) apply(o *storage.ObjectHandle) *storage.ObjectHandle {
+	if enc == nil || len(enc.Key) == 0 {
+		return o
+	}
+	return o.Key(enc.Key)
+}
+
+func (enc *ObjectEncryption) kmsKeyName() string {
+	if enc == nil {
+		return ""
+	}
+	return enc.KMSKeyName
+}
+
+// setHeaders adds the customer-supplied key headers to a request made without the
+// storage client
+func (enc *ObjectEncryption) setHeaders(h http.Header) {
+	if enc == nil || len(enc.Key) == 0 {
+		return
+	}
+	sum := sha256.Sum256(enc.Key)
+	h.Set("X-Goog-Encryption-Algorithm", "AES256")
+	h.Set("X-Goog-Encryption-Key", base64.StdEncoding.EncodeToString(enc.Key))
+	h.Set("X-Goog-Encryption-Key-Sha256", base64.StdEncoding.EncodeToString(sum[:]))
+}
+
+// WithEncryption returns a handle to the same bucket that encrypts and decrypts objects
+// with the given key
+func (gcpb *GoogleCloudStorageBucket) WithEncryption(enc *ObjectEncryption) *GoogleCloudStorageBucket {
+	clone := *gcpb
+	clone.Encryption = enc
+	return &clone
+}
+
+// object returns a handle to the object using the encryption of the bucket handle
+func (gcpb *GoogleCloudStorageBucket) object(key string) *storage.ObjectHandle {
+	return gcpb.Encryption.apply(gcpb.Client.Bucket(gcpb.Bucket).Object(key))
+}
+
+// encryption returns the encryption of a call, which overrides the one of the handle
+func (gcpb *GoogleCloudStorageBucket) encryption(override *ObjectEncryption) (*ObjectEncryption, error) {
+	enc := gcpb.Encryption
+	if override != nil {
+		enc = override
+	}
+	return enc, enc.validate()
+}
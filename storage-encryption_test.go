@@ -0,0 +1,144 @@
+package cloudygcp
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/appliedres/cloudy"
+	"github.com/stretchr/testify/assert"
+)
+
+func testKey(b byte) []byte {
+	return bytes.Repeat([]byte{b}, CustomerKeySize)
+}
+
+func keySHA256(key []byte) string {
+	sum := sha256.Sum256(key)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func TestCustomerSuppliedKey(t *testing.T) {
+	ctx := cloudy.StartContext()
+	fake, gcs := startFakeStorage(t)
+	plain := fake.createBucket(gcs, "encrypted")
+	bucket := plain.WithEncryption(&ObjectEncryption{Key: testKey(1)})
+
+	obj, err := bucket.UploadWithOptions(ctx, "secret.txt", bytes.NewReader([]byte("classified")), nil)
+	assert.Nil(t, err)
+	assert.Equal(t, keySHA256(testKey(1)), obj.CustomerKeySHA256)
+	assert.Equal(t, keySHA256(testKey(1)), fake.object("encrypted", "secret.txt").keySHA256)
+
+	reader, err := bucket.Download(ctx, "secret.txt")
+	assert.Nil(t, err)
+	data, _ := io.ReadAll(reader)
+	reader.Close()
+	assert.Equal(t, "classified", string(data))
+
+	// Reads without the key or with another key fail clearly
+	_, err = plain.Download(ctx, "secret.txt")
+	assert.True(t, errors.Is(err, ErrEncryptionKey))
+	_, err = plain.WithEncryption(&ObjectEncryption{Key: testKey(2)}).Download(ctx, "secret.txt")
+	assert.True(t, errors.Is(err, ErrEncryptionKey))
+
+	// The handle is not modified by WithEncryption
+	assert.Nil(t, plain.Encryption)
+
+	// A per call key overrides the key of the handle
+	_, err = bucket.UploadWithOptions(ctx, "other.txt", bytes.NewReader([]byte("other")), &UploadOptions{
+		Encryption: &ObjectEncryption{Key: testKey(2)},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, keySHA256(testKey(2)), fake.object("encrypted", "other.txt").keySHA256)
+
+	// Copying to another key rotates the key of the object
+	_, err = bucket.Copy(ctx, "secret.txt", "secret.txt", &CopyOptions{
+		Encryption: &ObjectEncryption{Key: testKey(3)},
+	})
+	assert.Nil(t, err)
+	_, err = bucket.Download(ctx, "secret.txt")
+	assert.True(t, errors.Is(err, ErrEncryptionKey))
+	assert.Equal(t, "classified", readObject(t, plain.WithEncryption(&ObjectEncryption{Key: testKey(3)}), "secret.txt"))
+}
+
+func TestCustomerSuppliedKeyUploads(t *testing.T) {
+	ctx := cloudy.StartContext()
+	fake, gcs := startFakeStorage(t)
+	bucket := fake.createBucket(gcs, "encrypted").WithEncryption(&ObjectEncryption{Key: testKey(4)})
+	data := testData(300 * 1024)
+
+	_, err := bucket.UploadResumable(ctx, "resumable.bin", bytes.NewReader(data), &ResumableUploadOptions{
+		UploadOptions: UploadOptions{ChunkSize: 256 * 1024},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, keySHA256(testKey(4)), fake.object("encrypted", "resumable.bin").keySHA256)
+	assert.Equal(t, string(data), readObject(t, bucket, "resumable.bin"))
+
+	_, err = bucket.UploadComposite(ctx, "composite.bin", bytes.NewReader(data), int64(len(data)), &CompositeUploadOptions{
+		Parts: 4,
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, keySHA256(testKey(4)), fake.object("encrypted", "composite.bin").keySHA256)
+	assert.Equal(t, string(data), readObject(t, bucket, "composite.bin"))
+}
+
+func TestKMSKey(t *testing.T) {
+	ctx := cloudy.StartContext()
+	fake, gcs := startFakeStorage(t)
+	plain := fake.createBucket(gcs, "cmek")
+	kms := "projects/test-project/locations/us/keyRings/ring/cryptoKeys/key"
+	bucket := plain.WithEncryption(&ObjectEncryption{KMSKeyName: kms})
+
+	obj, err := bucket.UploadWithOptions(ctx, "report.csv", bytes.NewReader([]byte("a,b")), nil)
+	assert.Nil(t, err)
+	assert.Equal(t, kms, obj.KMSKeyName)
+
+	_, err = bucket.UploadResumable(ctx, "large.csv", bytes.NewReader([]byte("c,d")), nil)
+	assert.Nil(t, err)
+	assert.Equal(t, kms, fake.object("cmek", "large.csv").kmsKeyName)
+
+	// Reads need no key
+	assert.Equal(t, "a,b", readObject(t, plain, "report.csv"))
+}
+
+func TestEncryptionValidation(t *testing.T) {
+	ctx := cloudy.StartContext()
+	fake, gcs := startFakeStorage(t)
+	bucket := fake.createBucket(gcs, "encrypted")
+
+	_, err := bucket.UploadWithOptions(ctx, "short.txt", bytes.NewReader([]byte("x")), &UploadOptions{
+		Encryption: &ObjectEncryption{Key: []byte("too short")},
+	})
+	assert.NotNil(t, err)
+
+	_, err = bucket.UploadWithOptions(ctx, "both.txt", bytes.NewReader([]byte("x")), &UploadOptions{
+		Encryption: &ObjectEncryption{Key: testKey(1), KMSKeyName: "key"},
+	})
+	assert.NotNil(t, err)
+	assert.Empty(t, fake.objectNames("encrypted"))
+}
+
+func TestEncryptionKeyFromSecret(t *testing.T) {
+	ctx := cloudy.StartContext()
+	_, sm := startFakeSecretManager(t, "test-project")
+
+	assert.Nil(t, sm.SaveSecretBinary(ctx, "raw-key", testKey(5)))
+	enc, err := EncryptionKeyFromSecret(ctx, sm, "raw-key")
+	assert.Nil(t, err)
+	assert.Equal(t, testKey(5), enc.Key)
+
+	assert.Nil(t, sm.SaveSecret(ctx, "encoded-key", base64.StdEncoding.EncodeToString(testKey(6))))
+	enc, err = EncryptionKeyFromSecret(ctx, sm, "encoded-key")
+	assert.Nil(t, err)
+	assert.Equal(t, testKey(6), enc.Key)
+
+	assert.Nil(t, sm.SaveSecret(ctx, "bad-key", "not a key"))
+	_, err = EncryptionKeyFromSecret(ctx, sm, "bad-key")
+	assert.NotNil(t, err)
+
+	_, err = EncryptionKeyFromSecret(ctx, sm, "missing-key")
+	assert.True(t, errors.Is(err, cloudy.ErrKeyNotFound))
+}
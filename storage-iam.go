@@ -0,0 +1,250 @@
+package cloudygcp
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/appliedres/cloudy"
+	"google.golang.org/api/option"
+	raw "google.golang.org/api/storage/v1"
+)
+
+// policyVersion is the IAM policy version that supports conditional bindings
+const policyVersion = 3
+
+// MaxPolicyUpdateAttempts is the number of times UpdatePolicy reads and writes the policy
+// before giving up on concurrent changes
+const MaxPolicyUpdateAttempts = 5
+
+// BucketPolicy is the IAM policy of a bucket
+type BucketPolicy struct {
+	Bindings []*BucketBinding
+	// Version of the policy that was read. SetPolicy only succeeds if the policy was not
+	// changed since, an empty ETag overwrites any policy.
+	ETag string
+}
+
+// BucketBinding grants a role to members, optionally only when a condition is met
+type BucketBinding struct {
+	Role string
+	// Members such as "user:alice@example.com" or "serviceAccount:sa@project.iam.gserviceaccount.com"
+	Members   []string
+	Condition *BindingCondition
+}
+
+// BindingCondition is a CEL expression that limits a binding, such as
+// `resource.name.startsWith("projects/_/buckets/tenant/objects/reports/")`
+type BindingCondition struct {
+	Title       string
+	Description string
+	Expression  string
+}
+
+// Members returns the members granted the role without a condition
+func (p *BucketPolicy) Members(role string) []string {
+	if b := p.binding(role, nil); b != nil {
+		return b.Members
+	}
+	return nil
+}
+
+// Add grants the role to the member. Returns false if the member already had it.
+func (p *BucketPolicy) Add(role string, member string, cond *BindingCondition) bool {
+	b := p.binding(role, cond)
+	if b == nil {
+		b = &BucketBinding{Role: role, Condition: cond}
+		p.Bindings = append(p.Bindings, b)
+	}
+	for _, m := range b.Members {
+		if m == member {
+			return false
+		}
+	}
+	b.Members = append(b.Members, member)
+	return true
+}
+
+// Remove revokes the role from the member, bindings left without members are dropped.
+// Returns false if the member did not have the role.
+func (p *BucketPolicy) Remove(role string, member string, cond *BindingCondition) bool {
+	for i, b := range p.Bindings {
+		if b.Role != role || !sameCondition(b.Condition, cond) {
+			continue
+		}
+		for j, m := range b.Members {
+			if m != member {
+				continue
+			}
+			b.Members = append(b.Members[:j:j], b.Members[j+1:]...)
+			if len(b.Members) == 0 {
+				p.Bindings = append(p.Bindings[:i:i], p.Bindings[i+1:]...)
+			}
+			return true
+		}
+	}
+	return false
+}
+
+func (p *BucketPolicy) binding(role string, cond *BindingCondition) *BucketBinding {
+	for _, b := range p.Bindings {
+		if b.Role == role && sameCondition(b.Condition, cond) {
+			return b
+		}
+	}
+	return nil
+}
+
+func sameCondition(a *BindingCondition, b *BindingCondition) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// GetPolicy reads the IAM policy of the bucket, including conditional bindings
+func (gcps *GoogleCloudStorage) GetPolicy(ctx context.Context, key string) (*BucketPolicy, error) {
+	svc, err := gcps.iamService(key)
+	if err != nil {
+		return nil, err
+	}
+	policy, err := svc.Buckets.GetIamPolicy(key).OptionsRequestedPolicyVersion(policyVersion).Context(ctx).Do()
+	if err != nil {
+		return nil, classifyStorageError(fmt.Errorf("Bucket(%q).GetIamPolicy: %w", key, err))
+	}
+	return toBucketPolicy(policy), nil
+}
+
+// SetPolicy replaces the IAM policy of the bucket. It fails with ErrPreconditionFailed
+// when the policy was changed since it was read, see UpdatePolicy to retry. Returns the
+// policy that was stored, with its new ETag.
+func (gcps *GoogleCloudStorage) SetPolicy(ctx context.Context, key string, policy *BucketPolicy) (*BucketPolicy, error) {
+	for _, b := range policy.Bindings {
+		if b.Role == "" || len(b.Members) == 0 {
+			return nil, cloudy.Error(ctx, "SetPolicy(%q): bindings need a role and members", key)
+		}
+		if b.Condition != nil && b.Condition.Expression == "" {
+			return nil, cloudy.Error(ctx, "SetPolicy(%q): condition of %v has no expression", key, b.Role)
+		}
+	}
+
+	svc, err := gcps.iamService(key)
+	if err != nil {
+		return nil, err
+	}
+	stored, err := svc.Buckets.SetIamPolicy(key, fromBucketPolicy(policy)).Context(ctx).Do()
+	if err != nil {
+		return nil, classifyStorageError(fmt.Errorf("Bucket(%q).SetIamPolicy: %w", key, err))
+	}
+	return toBucketPolicy(stored), nil
+}
+
+// UpdatePolicy reads the policy, lets update modify it and writes it back. When another
+// update wins the race the policy is read again and update is called again, up to
+// MaxPolicyUpdateAttempts times. The policy is not written if update returns false.
+func (gcps *GoogleCloudStorage) UpdatePolicy(ctx context.Context, key string, update func(policy *BucketPolicy) bool) (*BucketPolicy, error) {
+	var err error
+	for attempt := 0; attempt < MaxPolicyUpdateAttempts; attempt++ {
+		var policy *BucketPolicy
+		policy, err = gcps.GetPolicy(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		if !update(policy) {
+			return policy, nil
+		}
+		policy, err = gcps.SetPolicy(ctx, key, policy)
+		if !IsPreconditionFailed(err) {
+			return policy, err
+		}
+	}
+	return nil, err
+}
+
+// AddBinding grants the role to the member, only while the condition is met if one is
+// given. Returns whether the policy was changed.
+func (gcps *GoogleCloudStorage) AddBinding(ctx context.Context, key string, role string, member string, cond *BindingCondition) (bool, error) {
+	changed := false
+	_, err := gcps.UpdatePolicy(ctx, key, func(policy *BucketPolicy) bool {
+		changed = policy.Add(role, member, cond)
+		return changed
+	})
+	return changed && err == nil, err
+}
+
+// RemoveBinding revokes the role, granted with the given condition, from the member.
+// Returns whether the policy was changed.
+func (gcps *GoogleCloudStorage) RemoveBinding(ctx context.Context, key string, role string, member string, cond *BindingCondition) (bool, error) {
+	changed := false
+	_, err := gcps.UpdatePolicy(ctx, key, func(policy *BucketPolicy) bool {
+		changed = policy.Remove(role, member, cond)
+		return changed
+	})
+	return changed && err == nil, err
+}
+
+// iamPolicyClient creates the JSON API service of a GoogleCloudStorage on first use and
+// keeps it for the following policy calls
+type iamPolicyClient struct {
+	once sync.Once
+	svc  *raw.Service
+	err  error
+}
+
+// service returns the JSON API service using the HTTP client of the bucket handle. The
+// service outlives the call so it is not bound to its context.
+func (c *iamPolicyClient) service(gcpb *GoogleCloudStorageBucket) (*raw.Service, error) {
+	c.once.Do(func() {
+		ctx := context.Background()
+		hc, endpoint, err := gcpb.httpClient(ctx)
+		if err != nil {
+			c.err = err
+			return
+		}
+		c.svc, c.err = raw.NewService(ctx, option.WithHTTPClient(hc), option.WithEndpoint(endpoint))
+	})
+	return c.svc, c.err
+}
+
+// iamService returns the JSON API service of the policy calls, the storage client does
+// not expose the ETag of version 3 policies
+func (gcps *GoogleCloudStorage) iamService(key string) (*raw.Service, error) {
+	policies := gcps.policies
+	if policies == nil {
+		// Values that were not created by NewGoogleCloudStorage do not keep the service
+		policies = &iamPolicyClient{}
+	}
+	return policies.service(gcps.bucket(key))
+}
+
+func toBucketPolicy(policy *raw.Policy) *BucketPolicy {
+	p := &BucketPolicy{ETag: policy.Etag}
+	for _, b := range policy.Bindings {
+		binding := &BucketBinding{Role: b.Role, Members: b.Members}
+		if b.Condition != nil {
+			binding.Condition = &BindingCondition{
+				Title:       b.Condition.Title,
+				Description: b.Condition.Description,
+				Expression:  b.Condition.Expression,
+			}
+		}
+		p.Bindings = append(p.Bindings, binding)
+	}
+	return p
+}
+
+func fromBucketPolicy(p *BucketPolicy) *raw.Policy {
+	policy := &raw.Policy{Etag: p.ETag, Version: policyVersion, ForceSendFields: []string{"Bindings"}}
+	for _, b := range p.Bindings {
+		binding := &raw.PolicyBindings{Role: b.Role, Members: b.Members}
+		if b.Condition != nil {
+			binding.Condition = &raw.Expr{
+				Title:       b.Condition.Title,
+				Description: b.Condition.Description,
+				Expression:  b.Condition.Expression,
+			}
+		}
+		policy.Bindings = append(policy.Bindings, binding)
+	}
+	return policy
+}
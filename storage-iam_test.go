@@ -0,0 +1,128 @@
+package cloudygcp
+
+import (
+	"testing"
+
+	"github.com/appliedres/cloudy"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBucketPolicy(t *testing.T) {
+	ctx := cloudy.StartContext()
+	fake, gcs := startFakeStorage(t)
+	fake.createBucket(gcs, "tenant")
+	sa := "serviceAccount:tenant@test-project.iam.gserviceaccount.com"
+	reports := &BindingCondition{
+		Title:      "reports",
+		Expression: `resource.name.startsWith("projects/_/buckets/tenant/objects/reports/")`,
+	}
+
+	policy, err := gcs.GetPolicy(ctx, "tenant")
+	assert.Nil(t, err)
+	assert.Empty(t, policy.Bindings)
+
+	changed, err := gcs.AddBinding(ctx, "tenant", "roles/storage.objectViewer", sa, nil)
+	assert.Nil(t, err)
+	assert.True(t, changed)
+	changed, err = gcs.AddBinding(ctx, "tenant", "roles/storage.objectAdmin", sa, reports)
+	assert.Nil(t, err)
+	assert.True(t, changed)
+	changed, err = gcs.AddBinding(ctx, "tenant", "roles/storage.objectViewer", sa, nil)
+	assert.Nil(t, err)
+	assert.False(t, changed)
+
+	policy, err = gcs.GetPolicy(ctx, "tenant")
+	assert.Nil(t, err)
+	assert.Len(t, policy.Bindings, 2)
+	assert.Equal(t, []string{sa}, policy.Members("roles/storage.objectViewer"))
+	assert.Empty(t, policy.Members("roles/storage.objectAdmin"))
+	assert.Equal(t, reports, policy.binding("roles/storage.objectAdmin", reports).Condition)
+
+	// The conditional binding is only removed with its condition
+	changed, err = gcs.RemoveBinding(ctx, "tenant", "roles/storage.objectAdmin", sa, nil)
+	assert.Nil(t, err)
+	assert.False(t, changed)
+	changed, err = gcs.RemoveBinding(ctx, "tenant", "roles/storage.objectAdmin", sa, reports)
+	assert.Nil(t, err)
+	assert.True(t, changed)
+
+	policy, err = gcs.GetPolicy(ctx, "tenant")
+	assert.Nil(t, err)
+	assert.Len(t, policy.Bindings, 1)
+}
+
+func TestSetPolicyETag(t *testing.T) {
+	ctx := cloudy.StartContext()
+	fake, gcs := startFakeStorage(t)
+	fake.createBucket(gcs, "tenant")
+
+	stale, err := gcs.GetPolicy(ctx, "tenant")
+	assert.Nil(t, err)
+	_, err = gcs.AddBinding(ctx, "tenant", "roles/storage.objectViewer", "user:alice@example.com", nil)
+	assert.Nil(t, err)
+
+	// Writing a policy read before the binding was added must not drop it
+	stale.Add("roles/storage.objectViewer", "user:bob@example.com", nil)
+	_, err = gcs.SetPolicy(ctx, "tenant", stale)
+	assert.True(t, IsPreconditionFailed(err))
+
+	policy, err := gcs.GetPolicy(ctx, "tenant")
+	assert.Nil(t, err)
+	policy.Add("roles/storage.objectViewer", "user:bob@example.com", nil)
+	stored, err := gcs.SetPolicy(ctx, "tenant", policy)
+	assert.Nil(t, err)
+	assert.NotEqual(t, policy.ETag, stored.ETag)
+	assert.Equal(t, []string{"user:alice@example.com", "user:bob@example.com"}, stored.Members("roles/storage.objectViewer"))
+
+	// Concurrent writers are retried
+	fake.staleIAMWrites = 2
+	changed, err := gcs.AddBinding(ctx, "tenant", "roles/storage.objectViewer", "user:carol@example.com", nil)
+	assert.Nil(t, err)
+	assert.True(t, changed)
+
+	fake.staleIAMWrites = MaxPolicyUpdateAttempts
+	_, err = gcs.AddBinding(ctx, "tenant", "roles/storage.objectViewer", "user:dave@example.com", nil)
+	assert.True(t, IsPreconditionFailed(err))
+
+	_, err = gcs.SetPolicy(ctx, "tenant", &BucketPolicy{Bindings: []*BucketBinding{{Role: "roles/storage.objectViewer"}}})
+	assert.NotNil(t, err)
+}
+
+func TestPublicAccessWithConditionalBinding(t *testing.T) {
+	ctx := cloudy.StartContext()
+	_, gcs := startFakeStorage(t)
+
+	_, err := gcs.Create(ctx, "public", true, nil)
+	assert.Nil(t, err)
+	_, err = gcs.AddBinding(ctx, "public", "roles/storage.objectAdmin", "user:alice@example.com", &BindingCondition{
+		Title:      "uploads",
+		Expression: `resource.name.startsWith("projects/_/buckets/public/objects/uploads/")`,
+	})
+	assert.Nil(t, err)
+
+	// The policy can no longer be read as version 1
+	_, err = gcs.Client.Bucket("public").IAM().Policy(ctx)
+	assert.NotNil(t, err)
+
+	areas, err := gcs.List(ctx)
+	assert.Nil(t, err)
+	assert.Len(t, areas, 1)
+	assert.Equal(t, "true", areas[0].Tags[PublicAccessTag])
+
+	area, err := gcs.GetItem(ctx, "public")
+	assert.Nil(t, err)
+	assert.Equal(t, "true", area.Tags[PublicAccessTag])
+}
+
+func TestBucketPolicyServiceShared(t *testing.T) {
+	fake, gcs := startFakeStorage(t)
+	fake.createBucket(gcs, "one")
+	fake.createBucket(gcs, "two")
+
+	// The policies of every bucket are read through the same service
+	first, err := gcs.iamService("one")
+	assert.Nil(t, err)
+	second, err := gcs.iamService("two")
+	assert.Nil(t, err)
+	assert.Same(t, first, second)
+}
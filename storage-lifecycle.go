@@ -0,0 +1,324 @@
+package cloudygcp
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"reflect"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/appliedres/cloudy"
+	"gopkg.in/yaml.v3"
+)
+
+// Storage classes of GCS buckets and objects
+const (
+	StorageClassStandard = "STANDARD"
+	StorageClassNearline = "NEARLINE"
+	StorageClassColdline = "COLDLINE"
+	StorageClassArchive  = "ARCHIVE"
+)
+
+// States of the objects matched by a lifecycle rule, empty matches both
+const (
+	LifecycleStateLive       = "live"
+	LifecycleStateNoncurrent = "noncurrent"
+)
+
+// lifecycleDateFormat is the format of CreatedBefore, GCS only accepts a date
+const lifecycleDateFormat = "2006-01-02"
+
+// Lifecycle is the set of lifecycle rules of a bucket. It can be kept as JSON or YAML and
+// loaded with ParseLifecycle, for example
+//
+//	rules:
+//	  - action: SetStorageClass
+//	    storageClass: COLDLINE
+//	    ageDays: 90
+//	  - action: Delete
+//	    state: noncurrent
+//	    numNewerVersions: 3
+type Lifecycle struct {
+	Rules []LifecycleRule `json:"rules" yaml:"rules"`
+}
+
+// LifecycleRule applies the action to the objects matching all of the conditions that
+// are set. The action is one of storage.DeleteAction, storage.SetStorageClassAction or
+// storage.AbortIncompleteMPUAction.
+type LifecycleRule struct {
+	Action string `json:"action" yaml:"action"`
+	// Storage class objects are moved to by storage.SetStorageClassAction
+	StorageClass string `json:"storageClass,omitempty" yaml:"storageClass,omitempty"`
+
+	// Days since the object (or multipart upload) was created
+	AgeDays int64 `json:"ageDays,omitempty" yaml:"ageDays,omitempty"`
+	// Only match objects created before this date (YYYY-MM-DD)
+	CreatedBefore string `json:"createdBefore,omitempty" yaml:"createdBefore,omitempty"`
+	// Only match versions with at least this many newer versions
+	NumNewerVersions int64 `json:"numNewerVersions,omitempty" yaml:"numNewerVersions,omitempty"`
+	// Days since the version became noncurrent
+	DaysSinceNoncurrent int64 `json:"daysSinceNoncurrent,omitempty" yaml:"daysSinceNoncurrent,omitempty"`
+	// LifecycleStateLive or LifecycleStateNoncurrent, empty for both
+	State string `json:"state,omitempty" yaml:"state,omitempty"`
+
+	MatchesPrefix       []string `json:"matchesPrefix,omitempty" yaml:"matchesPrefix,omitempty"`
+	MatchesSuffix       []string `json:"matchesSuffix,omitempty" yaml:"matchesSuffix,omitempty"`
+	MatchesStorageClass []string `json:"matchesStorageClass,omitempty" yaml:"matchesStorageClass,omitempty"`
+}
+
+// DeleteAfterDays deletes objects the given number of days after they are created
+func DeleteAfterDays(days int64) LifecycleRule {
+	return LifecycleRule{Action: storage.DeleteAction, AgeDays: days}
+}
+
+// MoveAfterDays moves objects to the storage class the given number of days after they
+// are created
+func MoveAfterDays(days int64, storageClass string) LifecycleRule {
+	return LifecycleRule{Action: storage.SetStorageClassAction, StorageClass: storageClass, AgeDays: days}
+}
+
+// KeepNewerVersions deletes noncurrent versions once there are more than count newer
+// versions of the object. The bucket needs versioning enabled.
+func KeepNewerVersions(count int64) LifecycleRule {
+	return LifecycleRule{Action: storage.DeleteAction, State: LifecycleStateNoncurrent, NumNewerVersions: count}
+}
+
+// AbortIncompleteUploadsAfterDays aborts XML API multipart uploads that have not completed
+// the given number of days after they were started
+func AbortIncompleteUploadsAfterDays(days int64) LifecycleRule {
+	return LifecycleRule{Action: storage.AbortIncompleteMPUAction, AgeDays: days}
+}
+
+// ParseLifecycle reads a lifecycle from JSON or YAML. Unknown fields are rejected and
+// every rule is validated.
+func ParseLifecycle(data []byte) (*Lifecycle, error) {
+	lc := &Lifecycle{}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(lc); err != nil {
+		return nil, fmt.Errorf("invalid lifecycle: %w", err)
+	}
+	if err := lc.Validate(); err != nil {
+		return nil, err
+	}
+	return lc, nil
+}
+
+// Validate checks that every rule has a known action and at least one condition
+func (lc *Lifecycle) Validate() error {
+	for i, rule := range lc.Rules {
+		if err := rule.validate(); err != nil {
+			return fmt.Errorf("lifecycle rule %v: %w", i, err)
+		}
+	}
+	return nil
+}
+
+func (r *LifecycleRule) validate() error {
+	switch r.Action {
+	case storage.DeleteAction:
+	case storage.SetStorageClassAction:
+		if r.StorageClass == "" {
+			return fmt.Errorf("%v requires a storage class", r.Action)
+		}
+	case storage.AbortIncompleteMPUAction:
+		if r.AgeDays <= 0 || r.hasObjectConditions() {
+			return fmt.Errorf("%v only accepts an age", r.Action)
+		}
+	default:
+		return fmt.Errorf("unknown action %q", r.Action)
+	}
+
+	switch r.State {
+	case "", LifecycleStateLive, LifecycleStateNoncurrent:
+	default:
+		return fmt.Errorf("unknown state %q", r.State)
+	}
+	if r.CreatedBefore != "" {
+		if _, err := time.Parse(lifecycleDateFormat, r.CreatedBefore); err != nil {
+			return fmt.Errorf("createdBefore must be a date (YYYY-MM-DD), %v", err)
+		}
+	}
+	if r.AgeDays <= 0 && !r.hasObjectConditions() {
+		return fmt.Errorf("%v rule has no conditions", r.Action)
+	}
+	return nil
+}
+
+func (r *LifecycleRule) hasObjectConditions() bool {
+	return r.CreatedBefore != "" || r.NumNewerVersions > 0 || r.DaysSinceNoncurrent > 0 || r.State != "" ||
+		len(r.MatchesPrefix) > 0 || len(r.MatchesSuffix) > 0 || len(r.MatchesStorageClass) > 0
+}
+
+func (r *LifecycleRule) toStorage() storage.LifecycleRule {
+	rule := storage.LifecycleRule{
+		Action: storage.LifecycleAction{
+			Type:         r.Action,
+			StorageClass: r.StorageClass,
+		},
+		Condition: storage.LifecycleCondition{
+			AgeInDays:               r.AgeDays,
+			NumNewerVersions:        r.NumNewerVersions,
+			DaysSinceNoncurrentTime: r.DaysSinceNoncurrent,
+			MatchesPrefix:           r.MatchesPrefix,
+			MatchesSuffix:           r.MatchesSuffix,
+			MatchesStorageClasses:   r.MatchesStorageClass,
+		},
+	}
+	if r.CreatedBefore != "" {
+		rule.Condition.CreatedBefore, _ = time.Parse(lifecycleDateFormat, r.CreatedBefore)
+	}
+	switch r.State {
+	case LifecycleStateLive:
+		rule.Condition.Liveness = storage.Live
+	case LifecycleStateNoncurrent:
+		rule.Condition.Liveness = storage.Archived
+	}
+	return rule
+}
+
+func fromStorageRule(rule storage.LifecycleRule) LifecycleRule {
+	r := LifecycleRule{
+		Action:              rule.Action.Type,
+		StorageClass:        rule.Action.StorageClass,
+		AgeDays:             rule.Condition.AgeInDays,
+		NumNewerVersions:    rule.Condition.NumNewerVersions,
+		DaysSinceNoncurrent: rule.Condition.DaysSinceNoncurrentTime,
+		MatchesPrefix:       rule.Condition.MatchesPrefix,
+		MatchesSuffix:       rule.Condition.MatchesSuffix,
+		MatchesStorageClass: rule.Condition.MatchesStorageClasses,
+	}
+	if !rule.Condition.CreatedBefore.IsZero() {
+		r.CreatedBefore = rule.Condition.CreatedBefore.Format(lifecycleDateFormat)
+	}
+	switch rule.Condition.Liveness {
+	case storage.Live:
+		r.State = LifecycleStateLive
+	case storage.Archived:
+		r.State = LifecycleStateNoncurrent
+	}
+	return r
+}
+
+// equal compares two rules, treating nil and empty lists as the same
+func (r LifecycleRule) equal(other LifecycleRule) bool {
+	return reflect.DeepEqual(r.normalized(), other.normalized())
+}
+
+func (r LifecycleRule) normalized() LifecycleRule {
+	if len(r.MatchesPrefix) == 0 {
+		r.MatchesPrefix = nil
+	}
+	if len(r.MatchesSuffix) == 0 {
+		r.MatchesSuffix = nil
+	}
+	if len(r.MatchesStorageClass) == 0 {
+		r.MatchesStorageClass = nil
+	}
+	return r
+}
+
+// GetLifecycle returns the lifecycle rules of the bucket
+func (gcps *GoogleCloudStorage) GetLifecycle(ctx context.Context, bucket string) (*Lifecycle, error) {
+	lc, _, err := gcps.lifecycle(ctx, bucket)
+	return lc, err
+}
+
+// SetLifecycle replaces the lifecycle rules of the bucket. The bucket is only updated
+// when the rules differ from the current ones, so applying the same lifecycle again is
+// a no-op. Returns whether the bucket was changed.
+func (gcps *GoogleCloudStorage) SetLifecycle(ctx context.Context, bucket string, lc *Lifecycle) (bool, error) {
+	if err := lc.Validate(); err != nil {
+		return false, cloudy.Error(ctx, "SetLifecycle(%q): %v", bucket, err)
+	}
+	current, metageneration, err := gcps.lifecycle(ctx, bucket)
+	if err != nil {
+		return false, err
+	}
+	if rulesEqual(current.Rules, lc.Rules) {
+		return false, nil
+	}
+	return true, gcps.updateLifecycle(ctx, bucket, lc.Rules, metageneration)
+}
+
+// MergeLifecycle adds the rules that the bucket does not already have, keeping the
+// existing ones. The update fails with ErrPreconditionFailed if the bucket was changed
+// concurrently. Returns whether the bucket was changed.
+func (gcps *GoogleCloudStorage) MergeLifecycle(ctx context.Context, bucket string, rules ...LifecycleRule) (bool, error) {
+	if err := (&Lifecycle{Rules: rules}).Validate(); err != nil {
+		return false, cloudy.Error(ctx, "MergeLifecycle(%q): %v", bucket, err)
+	}
+	current, metageneration, err := gcps.lifecycle(ctx, bucket)
+	if err != nil {
+		return false, err
+	}
+
+	merged := current.Rules
+	for _, rule := range rules {
+		if !containsRule(merged, rule) {
+			merged = append(merged, rule)
+		}
+	}
+	if len(merged) == len(current.Rules) {
+		return false, nil
+	}
+	return true, gcps.updateLifecycle(ctx, bucket, merged, metageneration)
+}
+
+// ApplyLifecycle parses a JSON or YAML lifecycle and sets it on the bucket
+func (gcps *GoogleCloudStorage) ApplyLifecycle(ctx context.Context, bucket string, data []byte) (bool, error) {
+	lc, err := ParseLifecycle(data)
+	if err != nil {
+		return false, cloudy.Error(ctx, "ApplyLifecycle(%q): %v", bucket, err)
+	}
+	return gcps.SetLifecycle(ctx, bucket, lc)
+}
+
+// lifecycle reads the rules of the bucket along with its metageneration
+func (gcps *GoogleCloudStorage) lifecycle(ctx context.Context, bucket string) (*Lifecycle, int64, error) {
+	battrs, err := gcps.Client.Bucket(bucket).Attrs(ctx)
+	if err != nil {
+		return nil, 0, classifyStorageError(fmt.Errorf("Bucket(%q).Attrs: %w", bucket, err))
+	}
+	lc := &Lifecycle{}
+	for _, rule := range battrs.Lifecycle.Rules {
+		lc.Rules = append(lc.Rules, fromStorageRule(rule))
+	}
+	return lc, battrs.MetaGeneration, nil
+}
+
+func (gcps *GoogleCloudStorage) updateLifecycle(ctx context.Context, bucket string, rules []LifecycleRule, metageneration int64) error {
+	lifecycle := storage.Lifecycle{}
+	for _, rule := range rules {
+		lifecycle.Rules = append(lifecycle.Rules, rule.toStorage())
+	}
+
+	handle := gcps.Client.Bucket(bucket).If(storage.BucketConditions{MetagenerationMatch: metageneration})
+	_, err := handle.Update(ctx, storage.BucketAttrsToUpdate{Lifecycle: &lifecycle})
+	if err != nil {
+		return classifyStorageError(fmt.Errorf("Bucket(%q).Update: %w", bucket, err))
+	}
+	return nil
+}
+
+func rulesEqual(a []LifecycleRule, b []LifecycleRule) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].equal(b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func containsRule(rules []LifecycleRule, rule LifecycleRule) bool {
+	for _, r := range rules {
+		if r.equal(rule) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,94 @@
+package cloudygcp
+
+import (
+	"testing"
+
+	"cloud.google.com/go/storage"
+	"github.com/appliedres/cloudy"
+	"github.com/stretchr/testify/assert"
+)
+
+const testLifecycleYAML = `
+rules:
+  - action: SetStorageClass
+    storageClass: COLDLINE
+    ageDays: 90
+  - action: Delete
+    state: noncurrent
+    numNewerVersions: 3
+  - action: AbortIncompleteMultipartUpload
+    ageDays: 7
+`
+
+func TestParseLifecycle(t *testing.T) {
+	lc, err := ParseLifecycle([]byte(testLifecycleYAML))
+	assert.Nil(t, err)
+	assert.Equal(t, []LifecycleRule{
+		MoveAfterDays(90, StorageClassColdline),
+		KeepNewerVersions(3),
+		AbortIncompleteUploadsAfterDays(7),
+	}, lc.Rules)
+
+	fromJSON, err := ParseLifecycle([]byte(`{"rules": [{"action": "Delete", "ageDays": 30, "matchesPrefix": ["tmp/"]}]}`))
+	assert.Nil(t, err)
+	assert.Equal(t, "tmp/", fromJSON.Rules[0].MatchesPrefix[0])
+
+	invalid := []string{
+		`{"rules": [{"action": "Archive", "ageDays": 1}]}`,
+		`{"rules": [{"action": "Delete"}]}`,
+		`{"rules": [{"action": "SetStorageClass", "ageDays": 1}]}`,
+		`{"rules": [{"action": "AbortIncompleteMultipartUpload", "ageDays": 1, "matchesPrefix": ["a"]}]}`,
+		`{"rules": [{"action": "Delete", "createdBefore": "yesterday"}]}`,
+		`{"rules": [{"action": "Delete", "age": 1}]}`,
+	}
+	for _, doc := range invalid {
+		_, err = ParseLifecycle([]byte(doc))
+		assert.NotNil(t, err, doc)
+	}
+}
+
+func TestLifecycle(t *testing.T) {
+	ctx := cloudy.StartContext()
+	fake, gcs := startFakeStorage(t)
+	fake.createBucket(gcs, "lifecycle")
+
+	changed, err := gcs.ApplyLifecycle(ctx, "lifecycle", []byte(testLifecycleYAML))
+	assert.Nil(t, err)
+	assert.True(t, changed)
+
+	lc, err := gcs.GetLifecycle(ctx, "lifecycle")
+	assert.Nil(t, err)
+	assert.Len(t, lc.Rules, 3)
+	assert.Equal(t, storage.SetStorageClassAction, lc.Rules[0].Action)
+	assert.Equal(t, LifecycleStateNoncurrent, lc.Rules[1].State)
+
+	// Applying the same lifecycle again does not touch the bucket
+	before := fake.requestCount("PATCH", "/storage/v1/b/lifecycle")
+	changed, err = gcs.ApplyLifecycle(ctx, "lifecycle", []byte(testLifecycleYAML))
+	assert.Nil(t, err)
+	assert.False(t, changed)
+	assert.Equal(t, before, fake.requestCount("PATCH", "/storage/v1/b/lifecycle"))
+
+	changed, err = gcs.MergeLifecycle(ctx, "lifecycle", KeepNewerVersions(3), DeleteAfterDays(365))
+	assert.Nil(t, err)
+	assert.True(t, changed)
+
+	lc, err = gcs.GetLifecycle(ctx, "lifecycle")
+	assert.Nil(t, err)
+	assert.Len(t, lc.Rules, 4)
+	assert.Equal(t, DeleteAfterDays(365), lc.Rules[3])
+
+	changed, err = gcs.MergeLifecycle(ctx, "lifecycle", DeleteAfterDays(365))
+	assert.Nil(t, err)
+	assert.False(t, changed)
+
+	changed, err = gcs.SetLifecycle(ctx, "lifecycle", &Lifecycle{})
+	assert.Nil(t, err)
+	assert.True(t, changed)
+	lc, err = gcs.GetLifecycle(ctx, "lifecycle")
+	assert.Nil(t, err)
+	assert.Empty(t, lc.Rules)
+
+	_, err = gcs.GetLifecycle(ctx, "missing")
+	assert.True(t, IsNotFound(err))
+}
@@ -0,0 +1,139 @@
+package cloudygcp
+
+import (
+	"context"
+	"fmt"
+
+	"cloud.google.com/go/storage"
+	cloudystorage "github.com/appliedres/cloudy/storage"
+	"google.golang.org/api/iterator"
+)
+
+// DefaultListDelimiter groups keys into folders when listing
+const DefaultListDelimiter = "/"
+
+// DefaultListPageSize is the page size of ListPage when none is given
+const DefaultListPageSize = 1000
+
+// ListOptions controls the object listing functions
+type ListOptions struct {
+	// Only list keys starting with the prefix
+	Prefix string
+	// List every key under the prefix instead of grouping them into folders
+	Recursive bool
+	// Delimiter used to group keys into folders, defaults to DefaultListDelimiter
+	Delimiter string
+	// Only list keys that are lexicographically >= StartOffset
+	StartOffset string
+	// Only list keys that are lexicographically < EndOffset
+	EndOffset string
+
+	// Number of entries per page for ListPage, defaults to DefaultListPageSize
+	PageSize int
+	// Token returned by the previous page, empty for the first page
+	PageToken string
+}
+
+// ListPage is a single page of a listing
+type ListPage struct {
+	Objects  []*GoogleStoredObject
+	Prefixes []*cloudystorage.StoredPrefix
+	// Token of the next page, empty when this is the last page
+	NextPageToken string
+}
+
+// ObjectIterator streams the entries of a listing without holding them in memory
+type ObjectIterator struct {
+	it     *storage.ObjectIterator
+	bucket string
+}
+
+// Next returns the next entry, which is either an object or a prefix. iterator.Done is
+// returned when there are no more entries.
+func (oi *ObjectIterator) Next() (*GoogleStoredObject, *cloudystorage.StoredPrefix, error) {
+	attrs, err := oi.it.Next()
+	if err == iterator.Done {
+		return nil, nil, err
+	}
+	if err != nil {
+		return nil, nil, classifyStorageError(fmt.Errorf("Bucket(%q).Objects(): %w", oi.bucket, err))
+	}
+	if attrs.Name == "" {
+		return nil, &cloudystorage.StoredPrefix{Key: attrs.Prefix}, nil
+	}
+	return toStoredObject(attrs), nil, nil
+}
+
+func (opts *ListOptions) query() *storage.Query {
+	q := &storage.Query{
+		Prefix:      opts.Prefix,
+		StartOffset: opts.StartOffset,
+		EndOffset:   opts.EndOffset,
+	}
+	if !opts.Recursive {
+		q.Delimiter = opts.Delimiter
+		if q.Delimiter == "" {
+			q.Delimiter = DefaultListDelimiter
+		}
+	}
+	return q
+}
+
+// ListIterator returns an iterator over the objects and prefixes matching the options.
+// The paging options are ignored.
+func (gcpb *GoogleCloudStorageBucket) ListIterator(ctx context.Context, opts *ListOptions) *ObjectIterator {
+	if opts == nil {
+		opts = &ListOptions{}
+	}
+	return &ObjectIterator{
+		it:     gcpb.Client.Bucket(gcpb.Bucket).Objects(ctx, opts.query()),
+		bucket: gcpb.Bucket,
+	}
+}
+
+// ListEach calls fn for each object or prefix (exactly one of the two is set) matching the
+// options. Listing stops at the first error returned by fn.
+func (gcpb *GoogleCloudStorageBucket) ListEach(ctx context.Context, opts *ListOptions, fn func(obj *GoogleStoredObject, prefix *cloudystorage.StoredPrefix) error) error {
+	it := gcpb.ListIterator(ctx, opts)
+	for {
+		obj, prefix, err := it.Next()
+		if err == iterator.Done {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err = fn(obj, prefix); err != nil {
+			return err
+		}
+	}
+}
+
+// ListPage returns a single page of objects and prefixes. Pass the NextPageToken of the
+// result as the PageToken of the options to read the following page.
+func (gcpb *GoogleCloudStorageBucket) ListPage(ctx context.Context, opts *ListOptions) (*ListPage, error) {
+	if opts == nil {
+		opts = &ListOptions{}
+	}
+	pageSize := opts.PageSize
+	if pageSize <= 0 {
+		pageSize = DefaultListPageSize
+	}
+	it := gcpb.Client.Bucket(gcpb.Bucket).Objects(ctx, opts.query())
+
+	var entries []*storage.ObjectAttrs
+	next, err := iterator.NewPager(it, pageSize, opts.PageToken).NextPage(&entries)
+	if err != nil {
+		return nil, classifyStorageError(fmt.Errorf("Bucket(%q).Objects(): %w", gcpb.Bucket, err))
+	}
+
+	page := &ListPage{NextPageToken: next}
+	for _, attrs := range entries {
+		if attrs.Name == "" {
+			page.Prefixes = append(page.Prefixes, &cloudystorage.StoredPrefix{Key: attrs.Prefix})
+		} else {
+			page.Objects = append(page.Objects, toStoredObject(attrs))
+		}
+	}
+	return page, nil
+}
@@ -0,0 +1,90 @@
+package cloudygcp
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/appliedres/cloudy"
+	cloudystorage "github.com/appliedres/cloudy/storage"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/api/iterator"
+)
+
+func uploadKeys(t *testing.T, bucket *GoogleCloudStorageBucket, keys ...string) {
+	ctx := cloudy.StartContext()
+	for _, key := range keys {
+		err := bucket.Upload(ctx, key, bytes.NewReader([]byte(key)), nil)
+		assert.Nil(t, err)
+	}
+}
+
+func objectKeys(objects []*GoogleStoredObject) []string {
+	var keys []string
+	for _, obj := range objects {
+		keys = append(keys, obj.Key)
+	}
+	return keys
+}
+
+func TestListPage(t *testing.T) {
+	ctx := cloudy.StartContext()
+	fake, gcs := startFakeStorage(t)
+	bucket := fake.createBucket(gcs, "listing")
+	uploadKeys(t, bucket, "a.txt", "b.txt", "c.txt", "d.txt", "e.txt", "dir/one.txt", "dir/sub/two.txt")
+
+	var keys []string
+	token := ""
+	pages := 0
+	for {
+		page, err := bucket.ListPage(ctx, &ListOptions{Recursive: true, PageSize: 3, PageToken: token})
+		assert.Nil(t, err)
+		assert.LessOrEqual(t, len(page.Objects), 3)
+		assert.Empty(t, page.Prefixes)
+		keys = append(keys, objectKeys(page.Objects)...)
+		pages++
+		token = page.NextPageToken
+		if token == "" {
+			break
+		}
+	}
+	assert.Equal(t, 3, pages)
+	assert.Equal(t, []string{"a.txt", "b.txt", "c.txt", "d.txt", "dir/one.txt", "dir/sub/two.txt", "e.txt"}, keys)
+
+	page, err := bucket.ListPage(ctx, &ListOptions{StartOffset: "b", EndOffset: "d"})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"b.txt", "c.txt"}, objectKeys(page.Objects))
+}
+
+func TestListIterator(t *testing.T) {
+	ctx := cloudy.StartContext()
+	fake, gcs := startFakeStorage(t)
+	bucket := fake.createBucket(gcs, "listing")
+	uploadKeys(t, bucket, "a.txt", "dir/one.txt", "dir/sub/two.txt")
+
+	it := bucket.ListIterator(ctx, &ListOptions{Prefix: "dir/"})
+	obj, prefix, err := it.Next()
+	assert.Nil(t, err)
+	assert.Equal(t, "dir/one.txt", obj.Key)
+	assert.Nil(t, prefix)
+	obj, prefix, err = it.Next()
+	assert.Nil(t, err)
+	assert.Nil(t, obj)
+	assert.Equal(t, "dir/sub/", prefix.Key)
+	_, _, err = it.Next()
+	assert.Equal(t, iterator.Done, err)
+
+	var recursive []string
+	err = bucket.ListEach(ctx, &ListOptions{Recursive: true}, func(obj *GoogleStoredObject, prefix *cloudystorage.StoredPrefix) error {
+		recursive = append(recursive, obj.Key)
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"a.txt", "dir/one.txt", "dir/sub/two.txt"}, recursive)
+
+	objects, folders, err := bucket.List(ctx, "")
+	assert.Nil(t, err)
+	assert.Len(t, objects, 1)
+	assert.Equal(t, "a.txt", objects[0].Key)
+	assert.Len(t, folders, 1)
+	assert.Equal(t, "dir/", folders[0].Key)
+}
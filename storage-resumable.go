@@ -0,0 +1,347 @@
+package cloudygcp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"cloud.google.com/go/storage"
+	"github.com/appliedres/cloudy"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+	raw "google.golang.org/api/storage/v1"
+	htransport "google.golang.org/api/transport/http"
+)
+
+// DefaultResumableChunkSize is the chunk size used by UploadResumable when none is given
+const DefaultResumableChunkSize = 16 * 1024 * 1024
+
+// resumableChunkAlignment is the granularity GCS requires for all but the last chunk
+const resumableChunkAlignment = 256 * 1024
+
+// ResumableUploadOptions controls UploadResumable. The session URI of a new upload is
+// handed to OnSession as soon as the session is created. Persist it and pass it back as
+// SessionURI to continue the upload after a crash. Sessions are valid for a week.
+type ResumableUploadOptions struct {
+	UploadOptions
+
+	// Session to resume, empty to start a new upload
+	SessionURI string
+	// Called with the URI of a newly created session
+	OnSession func(sessionURI string)
+}
+
+// UploadResumable uploads the object through a GCS resumable upload session, one chunk
+// per request. When resuming, data must start at the beginning of the content. Content
+// already stored by GCS is skipped, by seeking when data is an io.Seeker and by reading
+// past it otherwise.
+func (gcpb *GoogleCloudStorageBucket) UploadResumable(ctx context.Context, key string, data io.Reader, opts *ResumableUploadOptions) (*GoogleStoredObject, error) {
+	if opts == nil {
+		opts = &ResumableUploadOptions{}
+	}
+	if err := opts.validate(); err != nil {
+		return nil, cloudy.Error(ctx, "UploadResumable(%q): %v", key, err)
+	}
+	enc, err := gcpb.encryption(opts.Encryption)
+	if err != nil {
+		return nil, cloudy.Error(ctx, "UploadResumable(%q): %v", key, err)
+	}
+
+	chunkSize := opts.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = DefaultResumableChunkSize
+	}
+	if rem := chunkSize % resumableChunkAlignment; rem != 0 {
+		chunkSize += resumableChunkAlignment - rem
+	}
+
+	hc, endpoint, err := gcpb.httpClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	session := opts.SessionURI
+	var offset int64
+	if session == "" {
+		session, err = gcpb.startResumableSession(ctx, hc, endpoint, key, &opts.UploadOptions, enc)
+		if err != nil {
+			return nil, err
+		}
+		if opts.OnSession != nil {
+			opts.OnSession(session)
+		}
+	} else {
+		var done *raw.Object
+		offset, done, err = gcpb.sendChunk(ctx, hc, session, enc, nil, 0, -1, true)
+		if err != nil {
+			return nil, err
+		}
+		if done != nil {
+			return gcpb.finishedObject(ctx, key, done)
+		}
+		if err = skipUploaded(data, offset); err != nil {
+			return nil, cloudy.Error(ctx, "UploadResumable(%q): unable to skip %v uploaded bytes, %v", key, offset, err)
+		}
+	}
+
+	buf := make([]byte, chunkSize)
+	for {
+		n, err := io.ReadFull(data, buf)
+		final := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !final {
+			return nil, cloudy.Error(ctx, "UploadResumable(%q): read failed, %v", key, err)
+		}
+
+		total := int64(-1)
+		if final {
+			total = offset + int64(n)
+		}
+
+		// GCS may persist less than was sent, in which case the rest is sent again
+		chunk := buf[:n]
+		for {
+			persisted, done, err := gcpb.sendChunk(ctx, hc, session, enc, chunk, offset, total, false)
+			if err != nil {
+				return nil, err
+			}
+			if opts.Progress != nil && persisted > offset {
+				opts.Progress(persisted)
+			}
+			if done != nil {
+				return gcpb.finishedObject(ctx, key, done)
+			}
+			if persisted < offset || persisted > offset+int64(len(chunk)) {
+				return nil, cloudy.Error(ctx, "UploadResumable(%q): unexpected persisted size %v", key, persisted)
+			}
+
+			chunk = chunk[persisted-offset:]
+			offset = persisted
+			if len(chunk) == 0 {
+				break
+			}
+		}
+
+		if final {
+			return nil, cloudy.Error(ctx, "UploadResumable(%q): upload was not finalized", key)
+		}
+	}
+}
+
+// startResumableSession creates the upload session and returns its URI
+func (gcpb *GoogleCloudStorageBucket) startResumableSession(ctx context.Context, hc *http.Client, endpoint string, key string, opts *UploadOptions, enc *ObjectEncryption) (string, error) {
+	params := url.Values{}
+	params.Set("uploadType", "resumable")
+	params.Set("name", key)
+	if opts.DoesNotExist {
+		params.Set("ifGenerationMatch", "0")
+	} else if opts.GenerationMatch != 0 {
+		params.Set("ifGenerationMatch", strconv.FormatInt(opts.GenerationMatch, 10))
+	}
+	if opts.MetagenerationMatch != 0 {
+		params.Set("ifMetagenerationMatch", strconv.FormatInt(opts.MetagenerationMatch, 10))
+	}
+	if name := enc.kmsKeyName(); name != "" {
+		params.Set("kmsKeyName", name)
+	}
+
+	body, err := json.Marshal(&raw.Object{
+		Name:        key,
+		ContentType: opts.ContentType,
+		Metadata:    prepareTags(ctx, opts.Tags),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	upload, err := uploadEndpoint(endpoint)
+	if err != nil {
+		return "", err
+	}
+	u := upload + "b/" + url.PathEscape(gcpb.Bucket) + "/o?" + params.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	if opts.ContentType != "" {
+		req.Header.Set("X-Upload-Content-Type", opts.ContentType)
+	}
+	enc.setHeaders(req.Header)
+
+	res, err := hc.Do(req)
+	if err != nil {
+		return "", classifyStorageError(fmt.Errorf("UploadResumable(%q): %w", key, err))
+	}
+	defer res.Body.Close()
+	if err = googleapi.CheckResponse(res); err != nil {
+		return "", classifyStorageError(fmt.Errorf("UploadResumable(%q): %w", key, err))
+	}
+
+	session := res.Header.Get("Location")
+	if session == "" {
+		return "", cloudy.Error(ctx, "UploadResumable(%q): no session URI returned", key)
+	}
+	return session, nil
+}
+
+// sendChunk sends the chunk starting at offset. The total size is -1 until the last chunk.
+// When query is set no data is sent and the status of the session is returned. The number
+// of bytes persisted by GCS is returned, along with the object once the upload is complete.
+// Customer-supplied keys are sent with every request of the session.
+func (gcpb *GoogleCloudStorageBucket) sendChunk(ctx context.Context, hc *http.Client, session string, enc *ObjectEncryption, chunk []byte, offset int64, total int64, query bool) (int64, *raw.Object, error) {
+	totalText := "*"
+	if total >= 0 {
+		totalText = strconv.FormatInt(total, 10)
+	}
+	contentRange := fmt.Sprintf("bytes %d-%d/%v", offset, offset+int64(len(chunk))-1, totalText)
+	if query || len(chunk) == 0 {
+		contentRange = fmt.Sprintf("bytes */%v", totalText)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, session, bytes.NewReader(chunk))
+	if err != nil {
+		return 0, nil, err
+	}
+	req.ContentLength = int64(len(chunk))
+	req.Header.Set("Content-Range", contentRange)
+	enc.setHeaders(req.Header)
+
+	res, err := hc.Do(req)
+	if err != nil {
+		return 0, nil, classifyStorageError(fmt.Errorf("UploadResumable: %w", err))
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK, http.StatusCreated:
+		obj := &raw.Object{}
+		if err = json.NewDecoder(res.Body).Decode(obj); err != nil {
+			return 0, nil, err
+		}
+		return int64(obj.Size), obj, nil
+	case http.StatusPermanentRedirect:
+		return persistedBytes(res.Header.Get("Range")), nil, nil
+	}
+
+	err = googleapi.CheckResponse(res)
+	if err == nil {
+		err = fmt.Errorf("unexpected status %v", res.Status)
+	}
+	return 0, nil, classifyStorageError(fmt.Errorf("UploadResumable: %w", err))
+}
+
+// finishedObject reads the attributes of the generation created by the upload
+func (gcpb *GoogleCloudStorageBucket) finishedObject(ctx context.Context, key string, obj *raw.Object) (*GoogleStoredObject, error) {
+	attrs, err := gcpb.object(key).Generation(obj.Generation).Attrs(ctx)
+	if err != nil {
+		return nil, classifyStorageError(fmt.Errorf("Object(%q).Attrs: %w", key, err))
+	}
+	return toStoredObject(attrs), nil
+}
+
+// defaultJSONEndpoint is the base URL of the JSON API
+const defaultJSONEndpoint = "https://storage.googleapis.com/storage/v1/"
+
+// jsonAPIClient creates the HTTP client of a GoogleCloudStorage on first use and keeps it
+// for the following calls to the JSON API
+type jsonAPIClient struct {
+	once     sync.Once
+	hc       *http.Client
+	endpoint string
+	err      error
+}
+
+// client returns the HTTP client and the base URL of the JSON API. The client outlives
+// the call so it is not bound to its context.
+func (c *jsonAPIClient) client(creds GcpCredentials) (*http.Client, string, error) {
+	c.once.Do(func() {
+		c.hc, c.endpoint, c.err = newJSONAPIClient(context.Background(), creds)
+	})
+	return c.hc, c.endpoint, c.err
+}
+
+// httpClient returns the authenticated client for the calls that are not covered by the
+// storage client library, along with the base URL of the JSON API
+func (gcpb *GoogleCloudStorageBucket) httpClient(ctx context.Context) (*http.Client, string, error) {
+	if gcpb.jsonAPI == nil {
+		// Handles that were not created by GoogleCloudStorage do not keep the client
+		return newJSONAPIClient(ctx, gcpb.GcpCredentials)
+	}
+	return gcpb.jsonAPI.client(gcpb.GcpCredentials)
+}
+
+// newJSONAPIClient creates an authenticated client for the JSON API. An endpoint given in
+// the Options of the credentials is used, else STORAGE_EMULATOR_HOST, else the default.
+func newJSONAPIClient(ctx context.Context, creds GcpCredentials) (*http.Client, string, error) {
+	opts, err := creds.ClientOptions(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+
+	endpoint := defaultJSONEndpoint
+	if host := os.Getenv("STORAGE_EMULATOR_HOST"); host != "" {
+		endpoint = emulatorEndpoint(host)
+		if !creds.hasCredentials() {
+			opts = append(opts, option.WithoutAuthentication())
+		}
+	}
+
+	// Placed before the options so that their endpoint wins, like the storage client
+	defaults := []option.ClientOption{
+		option.WithScopes(storage.ScopeFullControl),
+		option.WithEndpoint(endpoint),
+	}
+	return htransport.NewClient(ctx, append(defaults, opts...)...)
+}
+
+// emulatorEndpoint returns the base URL of the JSON API of STORAGE_EMULATOR_HOST, which
+// may be given without a scheme in the same way as for the storage client
+func emulatorEndpoint(host string) string {
+	if !strings.Contains(host, "://") {
+		host = "http://" + host
+	}
+	return strings.TrimSuffix(host, "/") + "/storage/v1/"
+}
+
+// uploadEndpoint returns the base URL of the upload API on the host of the JSON API
+func uploadEndpoint(endpoint string) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", fmt.Errorf("invalid storage endpoint %q: %w", endpoint, err)
+	}
+	return u.ResolveReference(&url.URL{Path: "/upload/storage/v1/"}).String(), nil
+}
+
+// persistedBytes parses the Range header ("bytes=0-N") of an incomplete upload
+func persistedBytes(rng string) int64 {
+	i := strings.LastIndex(rng, "-")
+	if i < 0 {
+		return 0
+	}
+	last, err := strconv.ParseInt(rng[i+1:], 10, 64)
+	if err != nil {
+		return 0
+	}
+	return last + 1
+}
+
+// skipUploaded moves the data past the bytes that were already uploaded
+func skipUploaded(data io.Reader, offset int64) error {
+	if offset == 0 {
+		return nil
+	}
+	if seeker, ok := data.(io.Seeker); ok {
+		_, err := seeker.Seek(offset, io.SeekStart)
+		return err
+	}
+	_, err := io.CopyN(io.Discard, data, offset)
+	return err
+}
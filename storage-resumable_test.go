@@ -0,0 +1,193 @@
+package cloudygcp
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/appliedres/cloudy"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/api/option"
+)
+
+// failingReader returns an error once limit bytes have been read
+type failingReader struct {
+	data  []byte
+	limit int
+	pos   int
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if r.pos >= r.limit {
+		return 0, errors.New("connection lost")
+	}
+	n := copy(p, r.data[r.pos:r.limit])
+	r.pos += n
+	return n, nil
+}
+
+func testData(size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	return data
+}
+
+func TestUploadResumable(t *testing.T) {
+	ctx := cloudy.StartContext()
+	fake, gcs := startFakeStorage(t)
+	bucket := fake.createBucket(gcs, "resumable")
+	data := testData(600 * 1024)
+
+	var progress []int64
+	var session string
+	obj, err := bucket.UploadResumable(ctx, "large.bin", bytes.NewReader(data), &ResumableUploadOptions{
+		UploadOptions: UploadOptions{
+			Tags:      map[string]string{"owner": "tester"},
+			ChunkSize: 100 * 1024,
+			Progress: func(sent int64) {
+				progress = append(progress, sent)
+			},
+		},
+		OnSession: func(uri string) {
+			session = uri
+		},
+	})
+	assert.Nil(t, err)
+	assert.NotEmpty(t, session)
+
+	// The chunk size is rounded up to 256KiB
+	assert.Equal(t, []int64{256 * 1024, 512 * 1024, 600 * 1024}, progress)
+	assert.Equal(t, int64(len(data)), obj.Size)
+	assert.Equal(t, "tester", obj.Tags["owner"])
+	assert.Equal(t, data, fake.object("resumable", "large.bin").data)
+}
+
+func TestUploadResumableResume(t *testing.T) {
+	ctx := cloudy.StartContext()
+	fake, gcs := startFakeStorage(t)
+	bucket := fake.createBucket(gcs, "resumable")
+	data := testData(600 * 1024)
+
+	var session string
+	opts := &ResumableUploadOptions{
+		UploadOptions: UploadOptions{ChunkSize: 256 * 1024},
+		OnSession: func(uri string) {
+			session = uri
+		},
+	}
+	_, err := bucket.UploadResumable(ctx, "large.bin", &failingReader{data: data, limit: 300 * 1024}, opts)
+	assert.NotNil(t, err)
+	assert.NotEmpty(t, session)
+	assert.Nil(t, fake.object("resumable", "large.bin"))
+
+	// Resume with a reader that cannot seek
+	var progress []int64
+	obj, err := bucket.UploadResumable(ctx, "large.bin", io.MultiReader(bytes.NewReader(data)), &ResumableUploadOptions{
+		UploadOptions: UploadOptions{
+			ChunkSize: 256 * 1024,
+			Progress: func(sent int64) {
+				progress = append(progress, sent)
+			},
+		},
+		SessionURI: session,
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{512 * 1024, 600 * 1024}, progress)
+	assert.Equal(t, int64(len(data)), obj.Size)
+	assert.Equal(t, data, fake.object("resumable", "large.bin").data)
+}
+
+func TestUploadResumablePrecondition(t *testing.T) {
+	ctx := cloudy.StartContext()
+	fake, gcs := startFakeStorage(t)
+	bucket := fake.createBucket(gcs, "resumable")
+
+	_, err := bucket.UploadResumable(ctx, "file.txt", bytes.NewReader([]byte("one")), &ResumableUploadOptions{
+		UploadOptions: UploadOptions{DoesNotExist: true},
+	})
+	assert.Nil(t, err)
+
+	_, err = bucket.UploadResumable(ctx, "file.txt", bytes.NewReader([]byte("two")), &ResumableUploadOptions{
+		UploadOptions: UploadOptions{DoesNotExist: true},
+	})
+	assert.True(t, IsPreconditionFailed(err))
+	assert.Equal(t, []byte("one"), fake.object("resumable", "file.txt").data)
+}
+
+func TestStorageHTTPClientEndpoint(t *testing.T) {
+	ctx := cloudy.StartContext()
+	t.Setenv("STORAGE_EMULATOR_HOST", "localhost:9023")
+
+	bucket := &GoogleCloudStorageBucket{
+		GcpCredentials: GcpCredentials{Options: []option.ClientOption{option.WithoutAuthentication()}},
+		Bucket:         "b",
+	}
+	_, endpoint, err := bucket.httpClient(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, "http://localhost:9023/storage/v1/", endpoint)
+
+	// An endpoint in the options wins over the emulator
+	bucket.GcpCredentials.Options = append(bucket.GcpCredentials.Options, option.WithEndpoint("https://gcs.example.com/storage/v1/"))
+	_, endpoint, err = bucket.httpClient(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, "https://gcs.example.com/storage/v1/", endpoint)
+	upload, err := uploadEndpoint(endpoint)
+	assert.Nil(t, err)
+	assert.Equal(t, "https://gcs.example.com/upload/storage/v1/", upload)
+}
+
+func TestStorageHTTPClientShared(t *testing.T) {
+	ctx := cloudy.StartContext()
+	fake, gcs := startFakeStorage(t)
+
+	// Every handle of a GoogleCloudStorage uses the same client
+	first, endpoint, err := fake.createBucket(gcs, "one").httpClient(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, fake.server.URL+"/storage/v1/", endpoint)
+	second, _, err := fake.createBucket(gcs, "two").WithEncryption(nil).httpClient(ctx)
+	assert.Nil(t, err)
+	assert.Same(t, first, second)
+}
+
+func TestStorageHTTPClientCredentials(t *testing.T) {
+	ctx := cloudy.StartContext()
+
+	tokens := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"access_token":"fixture-token","token_type":"Bearer","expires_in":3600}`))
+	}))
+	defer tokens.Close()
+
+	var authorization string
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+	}))
+	defer target.Close()
+	t.Setenv("STORAGE_EMULATOR_HOST", target.URL)
+
+	// Configured credentials are still used with an emulator
+	_, creds := fixtureKey(t)
+	var key map[string]string
+	_ = json.Unmarshal([]byte(creds), &key)
+	key["token_uri"] = tokens.URL
+	data, _ := json.Marshal(key)
+
+	bucket := &GoogleCloudStorageBucket{
+		GcpCredentials: GcpCredentials{CredentialsJSON: string(data)},
+		Bucket:         "b",
+	}
+	hc, endpoint, err := bucket.httpClient(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, target.URL+"/storage/v1/", endpoint)
+
+	res, err := hc.Get(endpoint)
+	assert.Nil(t, err)
+	res.Body.Close()
+	assert.Equal(t, "Bearer fixture-token", authorization)
+}
@@ -0,0 +1,201 @@
+package cloudygcp
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/appliedres/cloudy"
+	iamcredentials "google.golang.org/api/iamcredentials/v1"
+)
+
+// DefaultSignedURLExpiry is used when SignedURLOptions.Expires is not set
+const DefaultSignedURLExpiry = 15 * time.Minute
+
+// MaxSignedURLExpiry is the longest expiry allowed by V4 signing
+const MaxSignedURLExpiry = 7 * 24 * time.Hour
+
+// SignedURLOptions controls the V4 signed URLs created by SignedURL
+type SignedURLOptions struct {
+	// HTTP method the URL is valid for, defaults to GET
+	Method string
+	// How long the URL is valid for, defaults to DefaultSignedURLExpiry
+	Expires time.Duration
+	// Content type the client must send (PUT)
+	ContentType string
+	// Extension headers (x-goog-*) the client must send
+	Headers map[string]string
+}
+
+// serviceAccountKey is the subset of a service account JSON key used for signing
+type serviceAccountKey struct {
+	Type        string `json:"type"`
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+}
+
+// signingKey loads the service account key from the credentials. Nil is
+// returned when the credentials do not contain a key that can sign.
+func (c GcpCredentials) signingKey() (*serviceAccountKey, error) {
+	data := []byte(c.CredentialsJSON)
+	if len(data) == 0 && c.CredentialsFile != "" {
+		var err error
+		data, err = os.ReadFile(c.CredentialsFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(data) == 0 {
+		return nil, nil
+	}
+
+	key := &serviceAccountKey{}
+	if err := json.Unmarshal(data, key); err != nil {
+		return nil, err
+	}
+	if key.ClientEmail == "" || key.PrivateKey == "" {
+		return nil, nil
+	}
+	return key, nil
+}
+
+// SignedDownloadURL creates a V4 signed URL that allows the object to be downloaded
+func (gcpb *GoogleCloudStorageBucket) SignedDownloadURL(ctx context.Context, key string, expires time.Duration) (string, error) {
+	return gcpb.SignedURL(ctx, key, &SignedURLOptions{
+		Method:  http.MethodGet,
+		Expires: expires,
+	})
+}
+
+// SignedUploadURL creates a V4 signed URL that allows the object to be uploaded with a PUT
+func (gcpb *GoogleCloudStorageBucket) SignedUploadURL(ctx context.Context, key string, contentType string, expires time.Duration) (string, error) {
+	return gcpb.SignedURL(ctx, key, &SignedURLOptions{
+		Method:      http.MethodPut,
+		Expires:     expires,
+		ContentType: contentType,
+	})
+}
+
+// SignedURL creates a V4 signed URL for the object. When a SigningServiceAccount (or
+// ImpersonateServiceAccount) is configured the URL is signed by the IAM signBlob API on
+// behalf of that account. Otherwise it is signed with the service account key from the
+// credentials. When neither is available the signer is detected from the client.
+func (gcpb *GoogleCloudStorageBucket) SignedURL(ctx context.Context, key string, opts *SignedURLOptions) (string, error) {
+	if opts == nil {
+		opts = &SignedURLOptions{}
+	}
+
+	method := opts.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+	expires := opts.Expires
+	if expires == 0 {
+		expires = DefaultSignedURLExpiry
+	}
+	if expires < 0 || expires > MaxSignedURLExpiry {
+		return "", cloudy.Error(ctx, "SignedURL(%q): expiry must be between 0 and %v", key, MaxSignedURLExpiry)
+	}
+
+	var headers []string
+	for k, v := range opts.Headers {
+		headers = append(headers, fmt.Sprintf("%v:%v", k, v))
+	}
+	sort.Strings(headers)
+
+	signOpts := &storage.SignedURLOptions{
+		Scheme:      storage.SigningSchemeV4,
+		Method:      method,
+		Expires:     time.Now().Add(expires),
+		ContentType: opts.ContentType,
+		Headers:     headers,
+	}
+
+	saKey, err := gcpb.GcpCredentials.signingKey()
+	if err != nil {
+		return "", cloudy.Error(ctx, "SignedURL(%q): unable to read service account key, %v", key, err)
+	}
+
+	signer := gcpb.GcpCredentials.SigningServiceAccount
+	if signer == "" {
+		signer = gcpb.GcpCredentials.ImpersonateServiceAccount
+	}
+
+	var signed string
+	switch {
+	case signer != "":
+		signOpts.GoogleAccessID = signer
+		signOpts.SignBytes = func(payload []byte) ([]byte, error) {
+			return gcpb.signBlob(ctx, signer, payload)
+		}
+		signed, err = storage.SignedURL(gcpb.Bucket, key, signOpts)
+	case saKey != nil:
+		signOpts.GoogleAccessID = saKey.ClientEmail
+		signOpts.PrivateKey = []byte(saKey.PrivateKey)
+		signed, err = storage.SignedURL(gcpb.Bucket, key, signOpts)
+	default:
+		signed, err = gcpb.Client.Bucket(gcpb.Bucket).SignedURL(key, signOpts)
+	}
+
+	if err != nil {
+		return "", cloudy.Error(ctx, "SignedURL(%q): %v", key, err)
+	}
+	return signed, nil
+}
+
+// iamCredentialsClient creates the IAM credentials service of a bucket handle on first
+// use and keeps it for the following signatures
+type iamCredentialsClient struct {
+	once sync.Once
+	svc  *iamcredentials.Service
+	err  error
+}
+
+// service returns the IAM credentials service. Only the credential options are used, the
+// additional Options of the credentials are meant for the storage API. The service
+// outlives the call so it is not bound to its context.
+func (c *iamCredentialsClient) service(creds GcpCredentials) (*iamcredentials.Service, error) {
+	c.once.Do(func() {
+		if c.svc != nil {
+			return
+		}
+		ctx := context.Background()
+		opts, err := creds.credentialOptions(ctx)
+		if err != nil {
+			c.err = err
+			return
+		}
+		c.svc, c.err = iamcredentials.NewService(ctx, opts...)
+	})
+	return c.svc, c.err
+}
+
+// signBlob signs the payload with the Google managed key of the service account using
+// the IAM credentials API
+func (gcpb *GoogleCloudStorageBucket) signBlob(ctx context.Context, account string, payload []byte) ([]byte, error) {
+	signing := gcpb.signing
+	if signing == nil {
+		// Handles that were not created by GoogleCloudStorage do not keep the service
+		signing = &iamCredentialsClient{}
+	}
+	svc, err := signing.service(gcpb.GcpCredentials)
+	if err != nil {
+		return nil, err
+	}
+
+	name := "projects/-/serviceAccounts/" + account
+	resp, err := svc.Projects.ServiceAccounts.SignBlob(name, &iamcredentials.SignBlobRequest{
+		Payload: base64.StdEncoding.EncodeToString(payload),
+	}).Context(ctx).Do()
+	if err != nil {
+		return nil, classifyStorageError(fmt.Errorf("SignBlob(%q): %w", account, err))
+	}
+	return base64.StdEncoding.DecodeString(resp.SignedBlob)
+}
@@ -0,0 +1,180 @@
+package cloudygcp
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/appliedres/cloudy"
+	"github.com/stretchr/testify/assert"
+	iamcredentials "google.golang.org/api/iamcredentials/v1"
+	"google.golang.org/api/option"
+)
+
+const fixtureSigner = "signer@test-project.iam.gserviceaccount.com"
+
+// fixtureKey creates a service account key and the matching JSON credentials
+func fixtureKey(t *testing.T) (*rsa.PrivateKey, string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	keyPem := pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(key),
+	})
+	data, _ := json.Marshal(map[string]string{
+		"type":         "service_account",
+		"client_email": fixtureSigner,
+		"private_key":  string(keyPem),
+	})
+	return key, string(data)
+}
+
+// verifySignedURL rebuilds the V4 string to sign from the URL and checks the signature
+func verifySignedURL(t *testing.T, pub *rsa.PublicKey, method string, signed string, headers map[string]string) {
+	u, err := url.Parse(signed)
+	assert.Nil(t, err)
+
+	q := u.Query()
+	sig, err := hex.DecodeString(q.Get("X-Goog-Signature"))
+	assert.Nil(t, err)
+	q.Del("X-Goog-Signature")
+
+	all := map[string]string{"host": u.Host}
+	for k, v := range headers {
+		all[k] = v
+	}
+	var names []string
+	for k := range all {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders []string
+	for _, k := range names {
+		canonicalHeaders = append(canonicalHeaders, k+":"+all[k])
+	}
+	assert.Equal(t, strings.Join(names, ";"), q.Get("X-Goog-SignedHeaders"))
+
+	canonical := strings.Join([]string{
+		method,
+		u.EscapedPath(),
+		strings.Replace(q.Encode(), "+", "%20", -1),
+		strings.Join(canonicalHeaders, "\n") + "\n",
+		q.Get("X-Goog-SignedHeaders"),
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+	hash := sha256.Sum256([]byte(canonical))
+
+	scope := strings.SplitN(q.Get("X-Goog-Credential"), "/", 2)[1]
+	toSign := strings.Join([]string{
+		"GOOG4-RSA-SHA256",
+		q.Get("X-Goog-Date"),
+		scope,
+		hex.EncodeToString(hash[:]),
+	}, "\n")
+	digest := sha256.Sum256([]byte(toSign))
+
+	assert.Nil(t, rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig))
+}
+
+func TestSignedURLWithKey(t *testing.T) {
+	ctx := cloudy.StartContext()
+	key, creds := fixtureKey(t)
+	bucket := &GoogleCloudStorageBucket{
+		GcpCredentials: GcpCredentials{CredentialsJSON: creds},
+		Bucket:         "test-bucket",
+	}
+
+	signed, err := bucket.SignedURL(ctx, "folder/file name.txt", &SignedURLOptions{
+		Method:      http.MethodPut,
+		Expires:     time.Hour,
+		ContentType: "text/plain",
+		Headers:     map[string]string{"x-goog-meta-owner": "tester"},
+	})
+	assert.Nil(t, err)
+
+	u, _ := url.Parse(signed)
+	assert.Contains(t, []string{"3599", "3600"}, u.Query().Get("X-Goog-Expires"))
+	assert.True(t, strings.HasPrefix(u.Query().Get("X-Goog-Credential"), fixtureSigner+"/"))
+	verifySignedURL(t, &key.PublicKey, http.MethodPut, signed, map[string]string{
+		"content-type":      "text/plain",
+		"x-goog-meta-owner": "tester",
+	})
+
+	signed, err = bucket.SignedDownloadURL(ctx, "file.txt", 0)
+	assert.Nil(t, err)
+	u, _ = url.Parse(signed)
+	assert.Contains(t, []string{"899", "900"}, u.Query().Get("X-Goog-Expires"))
+	verifySignedURL(t, &key.PublicKey, http.MethodGet, signed, nil)
+
+	_, err = bucket.SignedDownloadURL(ctx, "file.txt", 8*24*time.Hour)
+	assert.NotNil(t, err)
+}
+
+func TestSignedURLWithSignBlob(t *testing.T) {
+	ctx := cloudy.StartContext()
+	key, _ := fixtureKey(t)
+
+	var signedFor string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		signedFor = strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/v1/projects/-/serviceAccounts/"), ":signBlob")
+
+		var req struct {
+			Payload string `json:"payload"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		payload, _ := base64.StdEncoding.DecodeString(req.Payload)
+		digest := sha256.Sum256(payload)
+		sig, _ := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"keyId":      "fixture",
+			"signedBlob": base64.StdEncoding.EncodeToString(sig),
+		})
+	}))
+	defer srv.Close()
+
+	svc, err := iamcredentials.NewService(ctx, option.WithEndpoint(srv.URL+"/"), option.WithoutAuthentication())
+	assert.Nil(t, err)
+	bucket := &GoogleCloudStorageBucket{
+		GcpCredentials: GcpCredentials{
+			SigningServiceAccount: fixtureSigner,
+			// Meant for the storage API, never passed to the IAM credentials service
+			Options: []option.ClientOption{option.WithEndpoint("http://storage.invalid/")},
+		},
+		Bucket:  "test-bucket",
+		signing: &iamCredentialsClient{svc: svc},
+	}
+
+	signed, err := bucket.SignedUploadURL(ctx, "upload.bin", "application/octet-stream", time.Minute)
+	assert.Nil(t, err)
+	assert.Equal(t, fixtureSigner, signedFor)
+	verifySignedURL(t, &key.PublicKey, http.MethodPut, signed, map[string]string{
+		"content-type": "application/octet-stream",
+	})
+
+	// The service is kept by the handle for the following URLs
+	signed, err = bucket.SignedDownloadURL(ctx, "upload.bin", time.Minute)
+	assert.Nil(t, err)
+	verifySignedURL(t, &key.PublicKey, http.MethodGet, signed, nil)
+	assert.Same(t, svc, bucket.signing.svc)
+
+	opts, err := bucket.GcpCredentials.credentialOptions(ctx)
+	assert.Nil(t, err)
+	assert.Empty(t, opts)
+}
@@ -0,0 +1,394 @@
+package cloudygcp
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/appliedres/cloudy"
+	cloudystorage "github.com/appliedres/cloudy/storage"
+)
+
+// DefaultSyncConcurrency is the number of files transferred at once by ApplySync
+const DefaultSyncConcurrency = 8
+
+// SyncDirection is the direction of a sync, the source side is copied to the other one
+type SyncDirection int
+
+const (
+	// SyncUpload copies the local directory to the bucket prefix
+	SyncUpload SyncDirection = iota
+	// SyncDownload copies the bucket prefix to the local directory
+	SyncDownload
+)
+
+// SyncActionType is what a SyncAction does to the destination
+type SyncActionType string
+
+const (
+	// SyncCopy uploads or downloads the file
+	SyncCopy SyncActionType = "copy"
+	// SyncDelete removes a file that is not in the source
+	SyncDelete SyncActionType = "delete"
+)
+
+// SyncOptions controls PlanSync and Sync
+type SyncOptions struct {
+	Direction SyncDirection
+	// Delete the destination files that are not in the source
+	Delete bool
+	// Only sync the files matching one of the patterns, everything when empty
+	Include []string
+	// Skip the files matching one of the patterns, they are never deleted
+	Exclude []string
+	// Number of files transferred at the same time, defaults to DefaultSyncConcurrency
+	Concurrency int
+}
+
+// SyncAction is a single change to the destination
+type SyncAction struct {
+	Type SyncActionType
+	// Path relative to the directory and prefix, using forward slashes
+	Path string
+	// Size of the source file, zero for deletes
+	Size int64
+	// Why the action is needed: "missing", "size", "checksum" or "extra"
+	Reason string
+}
+
+// SyncPlan lists the changes needed to make the destination match the source. It can be
+// reviewed before it is applied with ApplySync.
+type SyncPlan struct {
+	Direction SyncDirection
+	LocalDir  string
+	Prefix    string
+	Actions   []SyncAction
+	// Number of files that are identical on both sides
+	Unchanged int
+}
+
+// syncEntry is a file on either side of a sync
+type syncEntry struct {
+	size   int64
+	md5    string
+	crc32c string
+	// Full path of local files
+	file string
+}
+
+// Sync plans and applies a sync, returning the plan that was applied
+func (gcpb *GoogleCloudStorageBucket) Sync(ctx context.Context, localDir string, prefix string, opts *SyncOptions) (*SyncPlan, error) {
+	plan, err := gcpb.PlanSync(ctx, localDir, prefix, opts)
+	if err != nil {
+		return nil, err
+	}
+	return plan, gcpb.ApplySync(ctx, plan, opts)
+}
+
+// PlanSync compares the local directory with the objects under the prefix. Files are
+// the same when their sizes match and so does their MD5, or their CRC32C for objects
+// without an MD5 (composite uploads). Local files are only hashed when the sizes match.
+//
+// Include and exclude patterns are matched against the relative path. A pattern without
+// a slash matches the file name at any depth, otherwise it matches the whole path and
+// "**" matches any number of directories, as in "logs/**/*.gz".
+func (gcpb *GoogleCloudStorageBucket) PlanSync(ctx context.Context, localDir string, prefix string, opts *SyncOptions) (*SyncPlan, error) {
+	if opts == nil {
+		opts = &SyncOptions{}
+	}
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	filter := &syncFilter{include: opts.Include, exclude: opts.Exclude}
+	if err := filter.validate(); err != nil {
+		return nil, cloudy.Error(ctx, "PlanSync: %v", err)
+	}
+
+	local, err := localSyncEntries(localDir, filter)
+	if err != nil {
+		return nil, cloudy.Error(ctx, "PlanSync: unable to read %v, %v", localDir, err)
+	}
+	remote, err := gcpb.remoteSyncEntries(ctx, prefix, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	src, dst := local, remote
+	if opts.Direction == SyncDownload {
+		src, dst = remote, local
+	}
+
+	plan := &SyncPlan{
+		Direction: opts.Direction,
+		LocalDir:  localDir,
+		Prefix:    prefix,
+	}
+	for _, rel := range sortedKeys(src) {
+		s := src[rel]
+		d, ok := dst[rel]
+		reason := ""
+		switch {
+		case !ok:
+			reason = "missing"
+		case s.size != d.size:
+			reason = "size"
+		default:
+			same, err := sameContent(local[rel], remote[rel])
+			if err != nil {
+				return nil, cloudy.Error(ctx, "PlanSync: unable to hash %v, %v", rel, err)
+			}
+			if !same {
+				reason = "checksum"
+			}
+		}
+		if reason == "" {
+			plan.Unchanged++
+			continue
+		}
+		plan.Actions = append(plan.Actions, SyncAction{Type: SyncCopy, Path: rel, Size: s.size, Reason: reason})
+	}
+
+	if opts.Delete {
+		for _, rel := range sortedKeys(dst) {
+			if _, ok := src[rel]; !ok {
+				plan.Actions = append(plan.Actions, SyncAction{Type: SyncDelete, Path: rel, Reason: "extra"})
+			}
+		}
+	}
+	return plan, nil
+}
+
+// ApplySync performs the actions of the plan. Downloads are written to a temporary file
+// that replaces the destination once complete. The first failure stops the sync.
+func (gcpb *GoogleCloudStorageBucket) ApplySync(ctx context.Context, plan *SyncPlan, opts *SyncOptions) error {
+	concurrency := DefaultSyncConcurrency
+	if opts != nil && opts.Concurrency > 0 {
+		concurrency = opts.Concurrency
+	}
+
+	// Plans can be edited before they are applied
+	for _, action := range plan.Actions {
+		if !isLocalPath(action.Path) {
+			return cloudy.Error(ctx, "ApplySync: path %q is not inside %v", action.Path, plan.LocalDir)
+		}
+	}
+
+	return runParallel(ctx, len(plan.Actions), concurrency, func(ctx context.Context, i int) error {
+		action := plan.Actions[i]
+		key := plan.Prefix + action.Path
+		file := filepath.Join(plan.LocalDir, filepath.FromSlash(action.Path))
+
+		switch {
+		case action.Type == SyncCopy && plan.Direction == SyncUpload:
+			return gcpb.syncUpload(ctx, file, key)
+		case action.Type == SyncCopy:
+			return gcpb.syncDownload(ctx, key, file)
+		case plan.Direction == SyncUpload:
+			return ignoreNotFound(gcpb.Client.Bucket(gcpb.Bucket).Object(key).Delete(ctx), key)
+		default:
+			if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+				return cloudy.Error(ctx, "ApplySync: unable to delete %v, %v", file, err)
+			}
+			return nil
+		}
+	})
+}
+
+func (gcpb *GoogleCloudStorageBucket) syncUpload(ctx context.Context, file string, key string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return cloudy.Error(ctx, "ApplySync: unable to open %v, %v", file, err)
+	}
+	defer f.Close()
+	_, err = gcpb.UploadWithOptions(ctx, key, f, nil)
+	return err
+}
+
+func (gcpb *GoogleCloudStorageBucket) syncDownload(ctx context.Context, key string, file string) error {
+	if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+		return cloudy.Error(ctx, "ApplySync: unable to create %v, %v", filepath.Dir(file), err)
+	}
+	reader, err := gcpb.Download(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	tmp, err := os.CreateTemp(filepath.Dir(file), "."+filepath.Base(file)+".*")
+	if err != nil {
+		return cloudy.Error(ctx, "ApplySync: unable to create %v, %v", file, err)
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = io.Copy(tmp, reader)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), file)
+	}
+	if err != nil {
+		return cloudy.Error(ctx, "ApplySync: unable to write %v, %v", file, err)
+	}
+	return nil
+}
+
+// localSyncEntries walks the directory, a missing directory has no files
+func localSyncEntries(dir string, filter *syncFilter) (map[string]*syncEntry, error) {
+	entries := make(map[string]*syncEntry)
+	err := filepath.WalkDir(dir, func(file string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if file == dir && os.IsNotExist(err) {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, file)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if !filter.matches(rel) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		entries[rel] = &syncEntry{size: info.Size(), file: file}
+		return nil
+	})
+	return entries, err
+}
+
+func (gcpb *GoogleCloudStorageBucket) remoteSyncEntries(ctx context.Context, prefix string, filter *syncFilter) (map[string]*syncEntry, error) {
+	entries := make(map[string]*syncEntry)
+	err := gcpb.ListEach(ctx, &ListOptions{Prefix: prefix, Recursive: true}, func(obj *GoogleStoredObject, _ *cloudystorage.StoredPrefix) error {
+		rel := strings.TrimPrefix(obj.Key, prefix)
+		// Folder placeholders have no local counterpart
+		if rel == "" || strings.HasSuffix(rel, "/") || !filter.matches(rel) {
+			return nil
+		}
+		// Keys such as "../file" or "a//b" do not map to a file inside the directory
+		if path.Clean(rel) != rel || !isLocalPath(rel) {
+			cloudy.Warn(ctx, "Sync: skipping %v, it is not a valid relative path", obj.Key)
+			return nil
+		}
+		entries[rel] = &syncEntry{size: obj.Size, md5: obj.MD5, crc32c: obj.CRC32CHex}
+		return nil
+	})
+	return entries, err
+}
+
+// sameContent compares the checksums of a local file and an object of the same size
+func sameContent(local *syncEntry, remote *syncEntry) (bool, error) {
+	f, err := os.Open(local.file)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	md5Hash := md5.New()
+	crc := crc32.New(castagnoli)
+	if _, err = io.Copy(io.MultiWriter(md5Hash, crc), f); err != nil {
+		return false, err
+	}
+	if remote.md5 != "" {
+		return hex.EncodeToString(md5Hash.Sum(nil)) == remote.md5, nil
+	}
+	return hex.EncodeToString(crc.Sum(nil)) == remote.crc32c, nil
+}
+
+// isLocalPath reports whether the slash separated path stays inside the directory it is
+// relative to, in the same way as filepath.IsLocal
+func isLocalPath(rel string) bool {
+	file := filepath.FromSlash(rel)
+	if rel == "" || filepath.IsAbs(file) || filepath.VolumeName(file) != "" || strings.HasPrefix(rel, "/") {
+		return false
+	}
+	file = filepath.Clean(file)
+	return file != "." && file != ".." && !strings.HasPrefix(file, ".."+string(filepath.Separator))
+}
+
+func sortedKeys(entries map[string]*syncEntry) []string {
+	keys := make([]string, 0, len(entries))
+	for k := range entries {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// syncFilter applies the include and exclude patterns of a sync
+type syncFilter struct {
+	include []string
+	exclude []string
+}
+
+func (f *syncFilter) validate() error {
+	for _, pattern := range append(append([]string{}, f.include...), f.exclude...) {
+		if _, err := path.Match(strings.ReplaceAll(pattern, "**", "*"), ""); err != nil {
+			return fmt.Errorf("invalid pattern %q", pattern)
+		}
+	}
+	return nil
+}
+
+func (f *syncFilter) matches(rel string) bool {
+	for _, pattern := range f.exclude {
+		if matchGlob(pattern, rel) {
+			return false
+		}
+	}
+	if len(f.include) == 0 {
+		return true
+	}
+	for _, pattern := range f.include {
+		if matchGlob(pattern, rel) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchGlob matches a slash separated path against a pattern, see PlanSync
+func matchGlob(pattern string, rel string) bool {
+	if !strings.Contains(pattern, "/") {
+		ok, _ := path.Match(pattern, path.Base(rel))
+		return ok
+	}
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(rel, "/"))
+}
+
+func matchSegments(pattern []string, segments []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(segments); i++ {
+				if matchSegments(pattern[1:], segments[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(segments) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], segments[0]); !ok {
+			return false
+		}
+		pattern, segments = pattern[1:], segments[1:]
+	}
+	return len(segments) == 0
+}
@@ -0,0 +1,162 @@
+package cloudygcp
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/appliedres/cloudy"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	for name, content := range files {
+		file := filepath.Join(dir, filepath.FromSlash(name))
+		assert.Nil(t, os.MkdirAll(filepath.Dir(file), 0o755))
+		assert.Nil(t, os.WriteFile(file, []byte(content), 0o644))
+	}
+}
+
+func planSummary(plan *SyncPlan) map[string]string {
+	summary := make(map[string]string)
+	for _, action := range plan.Actions {
+		summary[action.Path] = string(action.Type) + ":" + action.Reason
+	}
+	return summary
+}
+
+func TestSyncUpload(t *testing.T) {
+	ctx := cloudy.StartContext()
+	fake, gcs := startFakeStorage(t)
+	bucket := fake.createBucket(gcs, "sync")
+
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"same.txt":        "same",
+		"changed.txt":     "locals",
+		"resized.txt":     "longer content",
+		"new/nested.txt":  "new",
+		"build/out.o":     "binary",
+		"notes/draft.tmp": "draft",
+	})
+	for key, content := range map[string]string{
+		"site/same.txt":    "same",
+		"site/changed.txt": "bucket",
+		"site/resized.txt": "short",
+		"site/extra.txt":   "extra",
+		"site/keep.tmp":    "excluded",
+	} {
+		_, err := bucket.UploadWithOptions(ctx, key, bytes.NewReader([]byte(content)), nil)
+		assert.Nil(t, err)
+	}
+
+	opts := &SyncOptions{
+		Direction: SyncUpload,
+		Delete:    true,
+		Exclude:   []string{"*.tmp", "build/**"},
+	}
+	plan, err := bucket.PlanSync(ctx, dir, "site", opts)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{
+		"changed.txt":    "copy:checksum",
+		"resized.txt":    "copy:size",
+		"new/nested.txt": "copy:missing",
+		"extra.txt":      "delete:extra",
+	}, planSummary(plan))
+	assert.Equal(t, 1, plan.Unchanged)
+
+	// Planning does not change anything
+	assert.Equal(t, "bucket", readObject(t, bucket, "site/changed.txt"))
+
+	err = bucket.ApplySync(ctx, plan, opts)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"site/changed.txt", "site/keep.tmp", "site/new/nested.txt", "site/resized.txt", "site/same.txt"}, fake.objectNames("sync"))
+	assert.Equal(t, "locals", readObject(t, bucket, "site/changed.txt"))
+
+	plan, err = bucket.PlanSync(ctx, dir, "site/", opts)
+	assert.Nil(t, err)
+	assert.Empty(t, plan.Actions)
+	assert.Equal(t, 4, plan.Unchanged)
+}
+
+func TestSyncDownload(t *testing.T) {
+	ctx := cloudy.StartContext()
+	fake, gcs := startFakeStorage(t)
+	bucket := fake.createBucket(gcs, "sync")
+	uploadKeys(t, bucket, "data/a.csv", "data/2023/b.csv", "data/2023/c.json")
+
+	dir := filepath.Join(t.TempDir(), "data")
+	plan, err := bucket.Sync(ctx, dir, "data/", &SyncOptions{
+		Direction: SyncDownload,
+		Include:   []string{"**/*.csv"},
+	})
+	assert.Nil(t, err)
+	assert.Len(t, plan.Actions, 2)
+
+	content, err := os.ReadFile(filepath.Join(dir, "2023", "b.csv"))
+	assert.Nil(t, err)
+	assert.Equal(t, "data/2023/b.csv", string(content))
+	_, err = os.Stat(filepath.Join(dir, "2023", "c.json"))
+	assert.True(t, os.IsNotExist(err))
+
+	// Local extras are deleted, excluded files are left alone
+	writeFiles(t, dir, map[string]string{"stale.csv": "stale", "local.json": "{}"})
+	plan, err = bucket.Sync(ctx, dir, "data/", &SyncOptions{
+		Direction: SyncDownload,
+		Delete:    true,
+		Include:   []string{"**/*.csv"},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"stale.csv": "delete:extra"}, planSummary(plan))
+	_, err = os.Stat(filepath.Join(dir, "stale.csv"))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(dir, "local.json"))
+	assert.Nil(t, err)
+}
+
+func TestMatchGlob(t *testing.T) {
+	assert.True(t, matchGlob("*.tmp", "a/b/c.tmp"))
+	assert.True(t, matchGlob("build/**", "build/x/y.o"))
+	assert.True(t, matchGlob("**/*.csv", "a.csv"))
+	assert.True(t, matchGlob("logs/**/*.gz", "logs/2023/01/x.gz"))
+	assert.False(t, matchGlob("logs/*.gz", "logs/2023/x.gz"))
+	assert.False(t, matchGlob("build/**", "src/build/x"))
+}
+
+func TestSyncDownloadOutsideDir(t *testing.T) {
+	ctx := cloudy.StartContext()
+	fake, gcs := startFakeStorage(t)
+	bucket := fake.createBucket(gcs, "sync")
+	uploadKeys(t, bucket, "data/ok.txt", "data/../escaped.txt", "data/a/../../up.txt", "data//double.txt")
+
+	root := t.TempDir()
+	dir := filepath.Join(root, "dir")
+	opts := &SyncOptions{Direction: SyncDownload}
+	plan, err := bucket.PlanSync(ctx, dir, "data/", opts)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"ok.txt": "copy:missing"}, planSummary(plan))
+	assert.Nil(t, bucket.ApplySync(ctx, plan, opts))
+
+	// Hand edited plans are checked as well
+	for _, rel := range []string{"../escaped.txt", "a/../../up.txt", "/abs.txt", ".."} {
+		edited := &SyncPlan{
+			Direction: SyncDownload,
+			LocalDir:  dir,
+			Prefix:    "data/",
+			Actions:   []SyncAction{{Type: SyncCopy, Path: "ok.txt"}, {Type: SyncCopy, Path: rel}},
+		}
+		assert.NotNil(t, bucket.ApplySync(ctx, edited, opts), rel)
+	}
+
+	var files []string
+	err = filepath.WalkDir(root, func(file string, d os.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			rel, _ := filepath.Rel(root, file)
+			files = append(files, filepath.ToSlash(rel))
+		}
+		return err
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"dir/ok.txt"}, files)
+}
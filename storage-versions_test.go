@@ -0,0 +1,82 @@
+package cloudygcp
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/appliedres/cloudy"
+	"github.com/stretchr/testify/assert"
+)
+
+func versionGenerations(versions []*GoogleStoredObject) []int64 {
+	var gens []int64
+	for _, v := range versions {
+		gens = append(gens, v.Generation)
+	}
+	return gens
+}
+
+func TestObjectVersions(t *testing.T) {
+	ctx := cloudy.StartContext()
+	fake, gcs := startFakeStorage(t)
+	bucket := fake.createBucket(gcs, "versioned")
+
+	versioning := true
+	_, err := gcs.UpdateBucket(ctx, "versioned", &BucketOptions{Versioning: &versioning})
+	assert.Nil(t, err)
+
+	var gens []int64
+	for _, content := range []string{"one", "two", "three"} {
+		obj, err := bucket.UploadWithOptions(ctx, "config.json", bytes.NewReader([]byte(content)), nil)
+		assert.Nil(t, err)
+		gens = append(gens, obj.Generation)
+	}
+	uploadKeys(t, bucket, "config.json.bak")
+
+	versions, err := bucket.ListVersions(ctx, "config.json")
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{gens[2], gens[1], gens[0]}, versionGenerations(versions))
+	assert.Equal(t, "config.json", fake.lastListQuery.Get("prefix"))
+	assert.True(t, versions[0].Deleted.IsZero())
+	assert.False(t, versions[1].Deleted.IsZero())
+
+	reader, err := bucket.DownloadGeneration(ctx, "config.json", gens[0])
+	assert.Nil(t, err)
+	data, _ := io.ReadAll(reader)
+	reader.Close()
+	assert.Equal(t, "one", string(data))
+
+	// Roll back the accidental overwrites
+	restored, err := bucket.RestoreGeneration(ctx, "config.json", gens[0])
+	assert.Nil(t, err)
+	assert.Greater(t, restored.Generation, gens[2])
+	assert.Equal(t, restored.MD5, versions[2].MD5)
+
+	reader, err = bucket.Download(ctx, "config.json")
+	assert.Nil(t, err)
+	data, _ = io.ReadAll(reader)
+	reader.Close()
+	assert.Equal(t, "one", string(data))
+
+	err = bucket.DeleteGeneration(ctx, "config.json", gens[1])
+	assert.Nil(t, err)
+	versions, err = bucket.ListVersions(ctx, "config.json")
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{restored.Generation, gens[2], gens[0]}, versionGenerations(versions))
+
+	// Deleting the live object keeps it as a noncurrent version
+	err = bucket.Delete(ctx, "config.json")
+	assert.Nil(t, err)
+	versions, err = bucket.ListVersions(ctx, "config.json")
+	assert.Nil(t, err)
+	assert.Len(t, versions, 3)
+	for _, v := range versions {
+		assert.False(t, v.Deleted.IsZero())
+	}
+
+	_, err = bucket.DownloadGeneration(ctx, "config.json", gens[1])
+	assert.True(t, IsNotFound(err))
+	err = bucket.DeleteGeneration(ctx, "config.json", gens[1])
+	assert.True(t, IsNotFound(err))
+}
@@ -2,11 +2,17 @@ package cloudygcp
 
 import (
 	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
+	"cloud.google.com/go/iam"
 	"cloud.google.com/go/storage"
 	"github.com/appliedres/cloudy"
 	cloudystorage "github.com/appliedres/cloudy/storage"
@@ -15,6 +21,14 @@ import (
 
 const GoogleCloudStorageDriver = "gcp-storage"
 
+// PublicAccessTag is added to the tags of the storage areas returned by List and GetItem.
+// It is "true" when the bucket grants allUsers read access and "false" otherwise. It is
+// left out when the IAM policy of the bucket cannot be read, and never saved as a label.
+const PublicAccessTag = "public-access"
+
+// PublicReaderRole is granted to allUsers on buckets created as open to the public
+const PublicReaderRole iam.RoleName = "roles/storage.objectViewer"
+
 var GoogleCloudStorageLabelRegExValue = regexp.MustCompile("^[a-z-_]*$")
 
 func init() {
@@ -22,12 +36,22 @@ func init() {
 }
 
 type GoogleCloudStorage struct {
+	GcpCredentials
 	Project string
 	Client  *storage.Client
+	// Settings of the buckets created by Create and CreateWithOptions
+	Defaults BucketOptions
+
+	// HTTP client of the JSON API calls, created on first use
+	jsonAPI *jsonAPIClient
+	// JSON API service of the IAM policy calls, created on first use
+	policies *iamPolicyClient
 }
 
 type GoogleCloudStorageConfig struct {
-	Project string
+	GcpCredentials
+	Project        string
+	BucketDefaults BucketOptions
 }
 
 type GoogleCloudStorageFactory struct{}
@@ -37,30 +61,59 @@ func (c *GoogleCloudStorageFactory) Create(cfg interface{}) (cloudystorage.Objec
 	if sec == nil {
 		return nil, cloudy.ErrInvalidConfiguration
 	}
-	return NewGoogleCloudStorage(context.Background(), sec.Project)
+	gcs, err := NewGoogleCloudStorage(context.Background(), sec.Project, sec.GcpCredentials)
+	if err != nil {
+		return nil, err
+	}
+	gcs.Defaults = sec.BucketDefaults
+	return gcs, nil
 }
 
 func (c *GoogleCloudStorageFactory) FromEnv(env *cloudy.Environment) (interface{}, error) {
 	cfg := &GoogleCloudStorageConfig{}
 	cfg.Project = env.Force("GCP_PROJECT")
+	cfg.GcpCredentials = GetCredentialsFromEnv(env)
+
+	defaults, err := bucketOptionsFromEnv(env)
+	if err != nil {
+		return nil, err
+	}
+	cfg.BucketDefaults = defaults
 	return cfg, nil
 }
 
 type GoogleCloudStorageBucket struct {
+	GcpCredentials
 	Project string
 	Bucket  string
 	Client  *storage.Client
+	// Encryption of the objects read and written through this handle, nil for the
+	// bucket default
+	Encryption *ObjectEncryption
+
+	// IAM credentials service used to sign URLs, created on first use
+	signing *iamCredentialsClient
+	// HTTP client of the JSON API calls, shared with the GoogleCloudStorage
+	jsonAPI *jsonAPIClient
 }
 
-func NewGoogleCloudStorage(ctx context.Context, project string) (*GoogleCloudStorage, error) {
-	client, err := storage.NewClient(ctx)
+func NewGoogleCloudStorage(ctx context.Context, project string, credentials GcpCredentials) (*GoogleCloudStorage, error) {
+	opts, err := credentials.ClientOptions(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := storage.NewClient(ctx, opts...)
 	if err != nil {
 		return nil, fmt.Errorf("storage.NewClient: %v", err)
 	}
 
 	return &GoogleCloudStorage{
-		Project: project,
-		Client:  client,
+		GcpCredentials: credentials,
+		Project:        project,
+		Client:         client,
+		jsonAPI:        &jsonAPIClient{},
+		policies:       &iamPolicyClient{},
 	}, nil
 }
 
@@ -70,10 +123,10 @@ func (gcps *GoogleCloudStorage) Exists(ctx context.Context, key string) (bool, e
 	_, err := bucket.Attrs(ctx)
 
 	if err != nil {
-		if gcps.isNotFound(err) {
+		if IsNotFound(err) {
 			return false, nil
 		}
-		return false, err
+		return false, classifyStorageError(err)
 	}
 
 	// Not sure what to do here. I guess just return true
@@ -89,14 +142,14 @@ func (gcps *GoogleCloudStorage) List(ctx context.Context) ([]*cloudystorage.Stor
 			break
 		}
 		if err != nil {
-			return nil, err
+			return nil, classifyStorageError(err)
 		}
 
-		rtn = append(rtn, &cloudystorage.StorageArea{
-			Name: battrs.Name,
-			Tags: battrs.Labels,
-		})
-
+		area, err := gcps.toStorageArea(ctx, battrs)
+		if err != nil {
+			return nil, err
+		}
+		rtn = append(rtn, area)
 	}
 	return rtn, nil
 }
@@ -106,18 +159,53 @@ func (gcps *GoogleCloudStorage) GetItem(ctx context.Context, key string) (*cloud
 	battrs, err := bucket.Attrs(ctx)
 
 	if err != nil {
-		return nil, err
+		return nil, classifyStorageError(err)
 	}
 
 	if battrs == nil {
 		return nil, nil
 	}
 
-	// Not sure what to do here. I guess just return true
-	return &cloudystorage.StorageArea{
-		Name: battrs.Name,
-		Tags: battrs.Labels,
-	}, nil
+	return gcps.toStorageArea(ctx, battrs)
+}
+
+// GoogleStorageArea is a storage area along with the GCS specific attributes of the bucket
+type GoogleStorageArea struct {
+	cloudystorage.StorageArea
+	Location          string
+	LocationType      string
+	StorageClass      string
+	Created           time.Time
+	VersioningEnabled bool
+	// Uniform bucket-level access disables object ACLs, objects have no Owner
+	UniformBucketLevelAccess bool
+	RequesterPays            bool
+	// Default CMEK key of new objects
+	KMSKeyName string
+	// Zero when the bucket has no retention policy
+	RetentionPeriod time.Duration
+	RetentionLocked bool
+	// Nil when GCS did not report a soft delete policy
+	SoftDeleteRetention *time.Duration
+}
+
+// GetItemDetails is GetItem with the GCS specific attributes of the bucket. The tags
+// include the PublicAccessTag in the same way.
+func (gcps *GoogleCloudStorage) GetItemDetails(ctx context.Context, key string) (*GoogleStorageArea, error) {
+	battrs, err := gcps.Client.Bucket(key).Attrs(ctx)
+	if err != nil {
+		return nil, classifyStorageError(fmt.Errorf("Bucket(%q).Attrs: %w", key, err))
+	}
+	area, err := gcps.toGoogleStorageArea(ctx, battrs)
+	if err != nil {
+		return nil, err
+	}
+
+	area.SoftDeleteRetention, err = gcps.softDeleteRetention(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return area, nil
 }
 
 func (gcps *GoogleCloudStorage) Get(ctx context.Context, key string) (cloudystorage.ObjectStorage, error) {
@@ -129,150 +217,342 @@ func (gcps *GoogleCloudStorage) Get(ctx context.Context, key string) (cloudystor
 		return nil, nil
 	}
 
-	return &GoogleCloudStorageBucket{
-		Project: gcps.Project,
-		Bucket:  key,
-		Client:  gcps.Client,
-	}, nil
+	return gcps.bucket(key), nil
 }
 
+// Create creates a bucket using the default bucket options, see CreateWithOptions
 func (gcps *GoogleCloudStorage) Create(ctx context.Context, key string, openToPublic bool, tags map[string]string) (cloudystorage.ObjectStorage, error) {
+	bucket, err := gcps.CreateWithOptions(ctx, key, &CreateBucketOptions{
+		OpenToPublic: openToPublic,
+		Tags:         tags,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return bucket, nil
+}
 
-	bucket := gcps.Client.Bucket(key)
+// toStorageArea converts the bucket attributes, reporting whether the bucket is public
+// through the PublicAccessTag. A bucket whose policy cannot be read is still returned.
+func (gcps *GoogleCloudStorage) toStorageArea(ctx context.Context, battrs *storage.BucketAttrs) (*cloudystorage.StorageArea, error) {
+	tags := make(map[string]string)
+	for k, v := range battrs.Labels {
+		tags[k] = v
+	}
 
-	attrs := &storage.BucketAttrs{
-		Labels: prepareTags(ctx, tags),
+	public, err := gcps.isPublic(ctx, battrs)
+	switch {
+	case err == nil:
+		tags[PublicAccessTag] = strconv.FormatBool(public)
+	case ctx.Err() != nil:
+		return nil, err
+	default:
+		// Reading the IAM policy needs more than listing buckets, the state is left unknown
+		cloudy.Warn(ctx, "Public access state unknown, %v", err)
 	}
 
-	err := bucket.Create(ctx, gcps.Project, attrs)
+	return &cloudystorage.StorageArea{
+		Name: battrs.Name,
+		Tags: tags,
+	}, nil
+}
 
+func (gcps *GoogleCloudStorage) toGoogleStorageArea(ctx context.Context, battrs *storage.BucketAttrs) (*GoogleStorageArea, error) {
+	storageArea, err := gcps.toStorageArea(ctx, battrs)
 	if err != nil {
-		return nil, cloudy.Error(ctx, "Bucket(%q).Create: %v", key, err)
+		return nil, err
 	}
+	area := &GoogleStorageArea{
+		StorageArea:              *storageArea,
+		Location:                 battrs.Location,
+		LocationType:             battrs.LocationType,
+		StorageClass:             battrs.StorageClass,
+		Created:                  battrs.Created,
+		VersioningEnabled:        battrs.VersioningEnabled,
+		UniformBucketLevelAccess: battrs.UniformBucketLevelAccess.Enabled,
+		RequesterPays:            battrs.RequesterPays,
+	}
+	if battrs.Encryption != nil {
+		area.KMSKeyName = battrs.Encryption.DefaultKMSKeyName
+	}
+	if battrs.RetentionPolicy != nil {
+		area.RetentionPeriod = battrs.RetentionPolicy.RetentionPeriod
+		area.RetentionLocked = battrs.RetentionPolicy.IsLocked
+	}
+	return area, nil
+}
 
+// isPublic determines if allUsers (or allAuthenticatedUsers) have been granted any role
+// on the bucket. Buckets enforcing public access prevention are never public, which is
+// known from the attributes alone. Only the other buckets need their IAM policy read.
+func (gcps *GoogleCloudStorage) isPublic(ctx context.Context, battrs *storage.BucketAttrs) (bool, error) {
+	if battrs.PublicAccessPrevention == storage.PublicAccessPreventionEnforced {
+		return false, nil
+	}
+
+	// Version 1 policies cannot be read once a conditional binding was added
+	policy, err := gcps.GetPolicy(ctx, battrs.Name)
+	if err != nil {
+		return false, err
+	}
+	for _, binding := range policy.Bindings {
+		for _, member := range binding.Members {
+			if member == iam.AllUsers || member == iam.AllAuthenticatedUsers {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+func (gcps *GoogleCloudStorage) bucket(key string) *GoogleCloudStorageBucket {
 	return &GoogleCloudStorageBucket{
-		Project: gcps.Project,
-		Bucket:  key,
-		Client:  gcps.Client,
-	}, nil
+		GcpCredentials: gcps.GcpCredentials,
+		Project:        gcps.Project,
+		Bucket:         key,
+		Client:         gcps.Client,
+		signing:        &iamCredentialsClient{},
+		jsonAPI:        gcps.jsonAPI,
+	}
 }
 
 func (gcps *GoogleCloudStorage) Delete(ctx context.Context, key string) error {
 	bucket := gcps.Client.Bucket(key)
 	err := bucket.Delete(ctx)
 
-	return err
+	return classifyStorageError(err)
+}
+
+// GoogleStoredObject is a stored object along with the GCS specific attributes. The MD5 of
+// the embedded StoredObject is hex encoded, it is empty for composite objects which only
+// have a CRC32C checksum.
+type GoogleStoredObject struct {
+	cloudystorage.StoredObject
+	ContentType    string
+	StorageClass   string
+	Generation     int64
+	Metageneration int64
+	Created        time.Time
+	Updated        time.Time
+	// When the generation became noncurrent, zero for live objects
+	Deleted time.Time
+	// Cloud KMS key or hash of the customer-supplied key the object is encrypted with
+	KMSKeyName        string
+	CustomerKeySHA256 string
+	// Entity owning the object, only set for buckets without uniform bucket-level access
+	Owner string
+
+	// Base64 encoded MD5, as used by the GCS API and the Content-MD5 header
+	MD5Base64 string
+	// CRC32C (Castagnoli) checksum of the content
+	CRC32C uint32
+	// Hex and base64 encoded big-endian CRC32C
+	CRC32CHex    string
+	CRC32CBase64 string
+}
+
+func toStoredObject(attrs *storage.ObjectAttrs) *GoogleStoredObject {
+	obj := &GoogleStoredObject{
+		StoredObject: cloudystorage.StoredObject{
+			Key:  attrs.Name,
+			Tags: attrs.Metadata,
+			Size: attrs.Size,
+		},
+		ContentType:       attrs.ContentType,
+		StorageClass:      attrs.StorageClass,
+		Generation:        attrs.Generation,
+		Metageneration:    attrs.Metageneration,
+		Created:           attrs.Created,
+		Updated:           attrs.Updated,
+		Deleted:           attrs.Deleted,
+		Owner:             attrs.Owner,
+		KMSKeyName:        attrs.KMSKeyName,
+		CustomerKeySHA256: attrs.CustomerKeySHA256,
+		CRC32C:            attrs.CRC32C,
+	}
+	if len(attrs.MD5) > 0 {
+		obj.MD5 = hex.EncodeToString(attrs.MD5)
+		obj.MD5Base64 = base64.StdEncoding.EncodeToString(attrs.MD5)
+	}
+
+	// GCS computes a CRC32C for every object, including composite ones
+	var crc [4]byte
+	binary.BigEndian.PutUint32(crc[:], attrs.CRC32C)
+	obj.CRC32CHex = hex.EncodeToString(crc[:])
+	obj.CRC32CBase64 = base64.StdEncoding.EncodeToString(crc[:])
+	return obj
+}
+
+// UploadOptions controls how UploadWithOptions writes an object. The preconditions
+// are evaluated by GCS when the upload is finalized, if they do not hold the upload
+// fails with an error matching ErrPreconditionFailed.
+type UploadOptions struct {
+	Tags        map[string]string
+	ContentType string
+
+	// Size of each request of a chunked upload, zero uses the client default (16MiB)
+	ChunkSize int
+	// Called with the number of bytes sent after each chunk
+	Progress func(sent int64)
+
+	// Only write the object if there is no live generation
+	DoesNotExist bool
+	// Only write the object if the live generation matches
+	GenerationMatch int64
+	// Only write the object if the live metageneration matches
+	MetagenerationMatch int64
+
+	// Overrides the encryption of the bucket handle
+	Encryption *ObjectEncryption
+}
+
+func (opts *UploadOptions) conditions() (storage.Conditions, bool) {
+	conds := storage.Conditions{
+		DoesNotExist:        opts.DoesNotExist,
+		GenerationMatch:     opts.GenerationMatch,
+		MetagenerationMatch: opts.MetagenerationMatch,
+	}
+	return conds, conds != storage.Conditions{}
 }
 
-func (gcps *GoogleCloudStorage) isNotFound(err error) bool {
-	msg := err.Error()
-	return strings.Contains(msg, "bucket doesn't exist")
+// validate checks that the preconditions can be evaluated together
+func (opts *UploadOptions) validate() error {
+	if opts.DoesNotExist && opts.GenerationMatch != 0 {
+		return fmt.Errorf("DoesNotExist and GenerationMatch cannot be combined")
+	}
+	return nil
 }
 
 // Implements ObjectStorage. Each instance represents a "bucket" in Google
 func (gcpb *GoogleCloudStorageBucket) Upload(ctx context.Context, key string, data io.Reader, tags map[string]string) error {
-	//TODO: Save tags
+	_, err := gcpb.UploadWithOptions(ctx, key, data, &UploadOptions{Tags: tags})
+	return err
+}
 
-	o := gcpb.Client.Bucket(gcpb.Bucket).Object(key)
+// UploadWithOptions uploads an object, optionally conditioned on the current state of
+// the object to avoid lost updates when several writers race on the same key. The
+// attributes of the written generation are returned.
+func (gcpb *GoogleCloudStorageBucket) UploadWithOptions(ctx context.Context, key string, data io.Reader, opts *UploadOptions) (*GoogleStoredObject, error) {
+	if opts == nil {
+		opts = &UploadOptions{}
+	}
+	if err := opts.validate(); err != nil {
+		return nil, cloudy.Error(ctx, "Upload(%q): %v", key, err)
+	}
 
-	// Optional: set a generation-match precondition to avoid potential race
-	// conditions and data corruptions. The request to upload is aborted if the
-	// object's generation number does not match your precondition.
-	// For an object that does not yet exist, set the DoesNotExist precondition.
-	// o = o.If(storage.Conditions{DoesNotExist: true})
+	enc, err := gcpb.encryption(opts.Encryption)
+	if err != nil {
+		return nil, cloudy.Error(ctx, "Upload(%q): %v", key, err)
+	}
+	o := enc.apply(gcpb.Client.Bucket(gcpb.Bucket).Object(key))
+	if conds, ok := opts.conditions(); ok {
+		o = o.If(conds)
+	}
 
-	// If the live object already exists in your bucket, set instead a
-	// generation-match precondition using the live object's generation number.
-	// attrs, err := o.Attrs(ctx)
-	// if err != nil {
-	//      return fmt.Errorf("object.Attrs: %v", err)
-	// }
-	// o = o.If(storage.Conditions{GenerationMatch: attrs.Generation})
+	// Upload an object with storage.Writer. The metadata is sent with the object so
+	// it is never visible without its tags. Cancelling the context aborts the upload
+	// if the copy fails.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-	// Upload an object with storage.Writer.
 	wc := o.NewWriter(ctx)
-	_, err := io.Copy(wc, data)
+	wc.Metadata = prepareTags(ctx, opts.Tags)
+	wc.ContentType = opts.ContentType
+	wc.ProgressFunc = opts.Progress
+	wc.KMSKeyName = enc.kmsKeyName()
+	if opts.ChunkSize > 0 {
+		wc.ChunkSize = opts.ChunkSize
+	}
+	_, err = io.Copy(wc, data)
 	if err != nil {
-		return fmt.Errorf("io.Copy: %v", err)
+		return nil, classifyStorageError(fmt.Errorf("io.Copy: %w", err))
 	}
 	err = wc.Close()
 	if err != nil {
-		return fmt.Errorf("Writer.Close: %v", err)
+		return nil, classifyStorageError(fmt.Errorf("Writer.Close: %w", err))
 	}
 
-	_, err = o.Update(ctx, storage.ObjectAttrsToUpdate{
-		Metadata: prepareTags(ctx, tags),
-	})
-
-	return err
+	return toStoredObject(wc.Attrs()), nil
 }
+
 func (gcpb *GoogleCloudStorageBucket) Exists(ctx context.Context, key string) (bool, error) {
-	o := gcpb.Client.Bucket(gcpb.Bucket).Object(key)
+	o := gcpb.object(key)
 
 	attrs, err := o.Attrs(ctx)
 	if err != nil {
-		if gcpb.isNotFound(err) {
+		if IsNotFound(err) {
 			return false, nil
 		}
-		return false, err
+		return false, classifyStorageError(err)
 	}
 	return attrs != nil, nil
 }
 func (gcpb *GoogleCloudStorageBucket) Download(ctx context.Context, key string) (io.ReadCloser, error) {
-	o := gcpb.Client.Bucket(gcpb.Bucket).Object(key)
+	o := gcpb.object(key)
 	reader, err := o.NewReader(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("Object(%q).NewReader: %v", key, err)
+		return nil, classifyStorageError(fmt.Errorf("Object(%q).NewReader: %w", key, err))
 	}
 	return reader, nil
 }
 
+// Stat returns the attributes and tags of an object without downloading it
+func (gcpb *GoogleCloudStorageBucket) Stat(ctx context.Context, key string) (*GoogleStoredObject, error) {
+	o := gcpb.object(key)
+	attrs, err := o.Attrs(ctx)
+	if err != nil {
+		return nil, classifyStorageError(fmt.Errorf("Object(%q).Attrs: %w", key, err))
+	}
+	return toStoredObject(attrs), nil
+}
+
+// DownloadWithAttrs opens a reader for the object and returns it along with the
+// attributes and tags of the generation being read.
+func (gcpb *GoogleCloudStorageBucket) DownloadWithAttrs(ctx context.Context, key string) (io.ReadCloser, *GoogleStoredObject, error) {
+	o := gcpb.object(key)
+	attrs, err := o.Attrs(ctx)
+	if err != nil {
+		return nil, nil, classifyStorageError(fmt.Errorf("Object(%q).Attrs: %w", key, err))
+	}
+
+	// Pin the generation so the content matches the attributes
+	reader, err := o.Generation(attrs.Generation).NewReader(ctx)
+	if err != nil {
+		return nil, nil, classifyStorageError(fmt.Errorf("Object(%q).NewReader: %w", key, err))
+	}
+	return reader, toStoredObject(attrs), nil
+}
+
 func (gcpb *GoogleCloudStorageBucket) Delete(ctx context.Context, key string) error {
-	o := gcpb.Client.Bucket(gcpb.Bucket).Object(key)
-	return o.Delete(ctx)
+	o := gcpb.object(key)
+	return classifyStorageError(o.Delete(ctx))
 }
 
 func (gcpb *GoogleCloudStorageBucket) List(ctx context.Context, prefix string) ([]*cloudystorage.StoredObject, []*cloudystorage.StoredPrefix, error) {
 	var objects []*cloudystorage.StoredObject
 	var folders []*cloudystorage.StoredPrefix
-	it := gcpb.Client.Bucket(gcpb.Bucket).Objects(ctx, &storage.Query{
-		Prefix:    prefix,
-		Delimiter: "/",
-	})
-	for {
-		attrs, err := it.Next()
-		if err == iterator.Done {
-			break
-		}
-		if err != nil {
-			return nil, nil, fmt.Errorf("Bucket(%q).Objects(): %v", gcpb.Bucket, err)
-		}
-		if attrs.Name == "" {
-			folders = append(folders, &cloudystorage.StoredPrefix{
-				Key: attrs.Prefix,
-			})
+	err := gcpb.ListEach(ctx, &ListOptions{Prefix: prefix}, func(obj *GoogleStoredObject, folder *cloudystorage.StoredPrefix) error {
+		if folder != nil {
+			folders = append(folders, folder)
 		} else {
-			objects = append(objects, &cloudystorage.StoredObject{
-				Key:  attrs.Name,
-				Tags: attrs.Metadata,
-				Size: attrs.Size,
-				MD5:  string(attrs.MD5),
-			})
+			objects = append(objects, &obj.StoredObject)
 		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
 	}
 
 	return objects, folders, nil
 }
 
-func (gcpb *GoogleCloudStorageBucket) isNotFound(err error) bool {
-	msg := err.Error()
-	return strings.Contains(msg, "Error 403:")
-}
-
 func prepareTags(ctx context.Context, tags map[string]string) map[string]string {
 	m := make(map[string]string)
 
 	for k, v := range tags {
+		if k == PublicAccessTag {
+			continue
+		}
 		k1 := strings.ToLower(k)
 		v1 := strings.ToLower(v)
 
@@ -1,16 +1,25 @@
 package cloudygcp
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
 	"log"
+	"net/http"
 	"testing"
 
+	"cloud.google.com/go/storage"
 	"github.com/appliedres/cloudy"
+	cloudystorage "github.com/appliedres/cloudy/storage"
 	"github.com/appliedres/cloudy/testutil"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/api/googleapi"
 )
 
 func TestBlobAccount(t *testing.T) {
 	ctx := cloudy.StartContext()
-	bsa, err := NewGoogleCloudStorage(ctx, "arklouddev")
+	bsa, err := NewGoogleCloudStorage(ctx, "arklouddev", GcpCredentials{})
 	if err != nil {
 		log.Fatal(err)
 		// t.FailNow()
@@ -38,9 +47,263 @@ func TestBlobAccount(t *testing.T) {
 	// }
 }
 
+func TestStorageErrorClassification(t *testing.T) {
+	assert.True(t, IsNotFound(storage.ErrBucketNotExist))
+	assert.True(t, IsNotFound(fmt.Errorf("wrapped: %w", storage.ErrObjectNotExist)))
+	assert.True(t, IsNotFound(&googleapi.Error{Code: 404}))
+	assert.True(t, IsForbidden(&googleapi.Error{Code: 403}))
+	assert.False(t, IsNotFound(&googleapi.Error{Code: 403}))
+	assert.True(t, IsPreconditionFailed(&googleapi.Error{Code: 412}))
+	assert.True(t, IsRateLimited(&googleapi.Error{Code: 429}))
+	assert.False(t, IsNotFound(errors.New("storage: bucket doesn't exist")))
+	assert.False(t, IsNotFound(nil))
+
+	err := classifyStorageError(fmt.Errorf("Object(%q).NewReader: %w", "key", storage.ErrObjectNotExist))
+	assert.True(t, errors.Is(err, cloudy.ErrKeyNotFound))
+	assert.True(t, errors.Is(err, storage.ErrObjectNotExist))
+
+	var apiErr *googleapi.Error
+	err = classifyStorageError(&googleapi.Error{Code: 412})
+	assert.True(t, errors.Is(err, ErrPreconditionFailed))
+	assert.True(t, errors.As(err, &apiErr))
+	assert.Nil(t, classifyStorageError(nil))
+
+	// Customer-supplied key failures are only recognized by their reason
+	assert.True(t, errors.Is(classifyStorageError(&googleapi.Error{
+		Code:   400,
+		Errors: []googleapi.ErrorItem{{Reason: "customerEncryptionKeySha256IsInvalid"}},
+	}), ErrEncryptionKey))
+	assert.True(t, errors.Is(classifyStorageError(&googleapi.Error{
+		Code: 400,
+		Body: "<?xml version='1.0' encoding='UTF-8'?><Error><Code>ResourceIsEncryptedWithCustomerEncryptionKey</Code></Error>",
+	}), ErrEncryptionKey))
+	err = classifyStorageError(&googleapi.Error{Code: 400, Message: "the encryption key of the bucket is not valid"})
+	assert.False(t, errors.Is(err, ErrEncryptionKey))
+	err = classifyStorageError(&googleapi.Error{Code: 403, Errors: []googleapi.ErrorItem{{Reason: "forbidden"}}})
+	assert.True(t, errors.Is(err, ErrPermissionDenied))
+}
+
+func TestUploadTags(t *testing.T) {
+	ctx := cloudy.StartContext()
+	fake, gcs := startFakeStorage(t)
+	bucket := fake.createBucket(gcs, "uploads")
+
+	obj, err := bucket.UploadWithOptions(ctx, "manifest.json", bytes.NewReader([]byte("one")), &UploadOptions{
+		Tags:        map[string]string{"kind": "manifest", "owner": "build"},
+		ContentType: "application/json",
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "application/json", obj.ContentType)
+	assert.Equal(t, map[string]string{"kind": "manifest", "owner": "build"}, obj.Tags)
+	assert.Equal(t, int64(3), obj.Size)
+
+	// The tags are written with the content, not by a second request
+	assert.Equal(t, 0, fake.requestCount("PATCH", "/storage/v1/b/uploads/o"))
+
+	stat, err := bucket.Stat(ctx, "manifest.json")
+	assert.Nil(t, err)
+	assert.Equal(t, obj.Tags, stat.Tags)
+	assert.Equal(t, obj.Generation, stat.Generation)
+	assert.Equal(t, "application/json", stat.ContentType)
+
+	reader, stored, err := bucket.DownloadWithAttrs(ctx, "manifest.json")
+	assert.Nil(t, err)
+	data, _ := io.ReadAll(reader)
+	reader.Close()
+	assert.Equal(t, "one", string(data))
+	assert.Equal(t, obj.Tags, stored.Tags)
+	assert.Equal(t, obj.Generation, stored.Generation)
+
+	// Upload keeps working with plain tags
+	assert.Nil(t, bucket.Upload(ctx, "plain.txt", bytes.NewReader([]byte("plain")), map[string]string{"kind": "plain"}))
+	stat, err = bucket.Stat(ctx, "plain.txt")
+	assert.Nil(t, err)
+	assert.Equal(t, "plain", stat.Tags["kind"])
+
+	_, err = bucket.Stat(ctx, "missing")
+	assert.True(t, errors.Is(err, cloudy.ErrKeyNotFound))
+	_, _, err = bucket.DownloadWithAttrs(ctx, "missing")
+	assert.True(t, errors.Is(err, cloudy.ErrKeyNotFound))
+}
+
+func TestUploadPreconditions(t *testing.T) {
+	ctx := cloudy.StartContext()
+	fake, gcs := startFakeStorage(t)
+	bucket := fake.createBucket(gcs, "uploads")
+
+	obj, err := bucket.UploadWithOptions(ctx, "manifest.json", bytes.NewReader([]byte("one")), &UploadOptions{
+		DoesNotExist: true,
+	})
+	assert.Nil(t, err)
+
+	// A second writer that expected the object to be missing loses
+	_, err = bucket.UploadWithOptions(ctx, "manifest.json", bytes.NewReader([]byte("two")), &UploadOptions{
+		DoesNotExist: true,
+	})
+	assert.True(t, IsPreconditionFailed(err))
+	assert.True(t, errors.Is(err, ErrPreconditionFailed))
+
+	_, err = bucket.UploadWithOptions(ctx, "manifest.json", bytes.NewReader([]byte("three")), &UploadOptions{
+		GenerationMatch: obj.Generation,
+	})
+	assert.Nil(t, err)
+
+	_, err = bucket.UploadWithOptions(ctx, "manifest.json", bytes.NewReader([]byte("four")), &UploadOptions{
+		GenerationMatch: obj.Generation,
+	})
+	assert.True(t, IsPreconditionFailed(err))
+
+	// Fresh generations start at metageneration 1
+	_, err = bucket.UploadWithOptions(ctx, "manifest.json", bytes.NewReader([]byte("five")), &UploadOptions{
+		MetagenerationMatch: 2,
+	})
+	assert.True(t, IsPreconditionFailed(err))
+
+	_, err = bucket.UploadWithOptions(ctx, "manifest.json", bytes.NewReader([]byte("six")), &UploadOptions{
+		MetagenerationMatch: 1,
+	})
+	assert.Nil(t, err)
+
+	// Conditions on a missing object fail rather than create it
+	_, err = bucket.UploadWithOptions(ctx, "missing.json", bytes.NewReader([]byte("seven")), &UploadOptions{
+		GenerationMatch: obj.Generation,
+	})
+	assert.True(t, IsPreconditionFailed(err))
+	assert.Nil(t, fake.object("uploads", "missing.json"))
+
+	reader, _, err := bucket.DownloadWithAttrs(ctx, "manifest.json")
+	assert.Nil(t, err)
+	data, _ := io.ReadAll(reader)
+	reader.Close()
+	assert.Equal(t, "six", string(data))
+}
+
+func TestStoredObjectMetadata(t *testing.T) {
+	ctx := cloudy.StartContext()
+	fake, gcs := startFakeStorage(t)
+	bucket := fake.createBucket(gcs, "metadata")
+
+	// Known checksums of "hello world"
+	_, err := bucket.UploadWithOptions(ctx, "hello.txt", bytes.NewReader([]byte("hello world")), &UploadOptions{
+		ContentType: "text/plain",
+	})
+	assert.Nil(t, err)
+
+	var listed *GoogleStoredObject
+	err = bucket.ListEach(ctx, nil, func(obj *GoogleStoredObject, prefix *cloudystorage.StoredPrefix) error {
+		listed = obj
+		return nil
+	})
+	assert.Nil(t, err)
+
+	stat, err := bucket.Stat(ctx, "hello.txt")
+	assert.Nil(t, err)
+
+	for _, obj := range []*GoogleStoredObject{listed, stat} {
+		assert.Equal(t, "5eb63bbbe01eeed093cb22bb8f5acdc3", obj.MD5)
+		assert.Equal(t, "XrY7u+Ae7tCTyyK7j1rNww==", obj.MD5Base64)
+		assert.Equal(t, uint32(0xc99465aa), obj.CRC32C)
+		assert.Equal(t, "c99465aa", obj.CRC32CHex)
+		assert.Equal(t, "yZRlqg==", obj.CRC32CBase64)
+		assert.Equal(t, "text/plain", obj.ContentType)
+		assert.Equal(t, "STANDARD", obj.StorageClass)
+		assert.Equal(t, "project-owners-test-project", obj.Owner)
+		assert.NotZero(t, obj.Generation)
+		assert.False(t, obj.Created.IsZero())
+		assert.False(t, obj.Updated.IsZero())
+	}
+
+	area, err := gcs.GetItemDetails(ctx, "metadata")
+	assert.Nil(t, err)
+	assert.Equal(t, "metadata", area.Name)
+	assert.Equal(t, "US", area.Location)
+	assert.Equal(t, "STANDARD", area.StorageClass)
+	assert.False(t, area.Created.IsZero())
+
+	_, err = gcs.GetItemDetails(ctx, "missing")
+	assert.True(t, IsNotFound(err))
+}
+
+func TestCreatePublicAccess(t *testing.T) {
+	ctx := cloudy.StartContext()
+	fake, gcs := startFakeStorage(t)
+
+	_, err := gcs.Create(ctx, "public", true, map[string]string{"team": "web"})
+	assert.Nil(t, err)
+	_, err = gcs.Create(ctx, "private", false, nil)
+	assert.Nil(t, err)
+
+	policy, err := gcs.GetPolicy(ctx, "public")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"allUsers"}, policy.Members(string(PublicReaderRole)))
+
+	area, err := gcs.GetItem(ctx, "public")
+	assert.Nil(t, err)
+	assert.Equal(t, "true", area.Tags[PublicAccessTag])
+	assert.Equal(t, "web", area.Tags["team"])
+
+	// Public access prevention is enough to know a bucket is private
+	before := fake.requestCount("GET", "/storage/v1/b/private/iam")
+	area, err = gcs.GetItem(ctx, "private")
+	assert.Nil(t, err)
+	assert.Equal(t, "false", area.Tags[PublicAccessTag])
+	assert.Equal(t, before, fake.requestCount("GET", "/storage/v1/b/private/iam"))
+
+	areas, err := gcs.List(ctx)
+	assert.Nil(t, err)
+	tags := map[string]string{}
+	for _, area := range areas {
+		tags[area.Name] = area.Tags[PublicAccessTag]
+	}
+	assert.Equal(t, map[string]string{"public": "true", "private": "false"}, tags)
+}
+
+func TestCreatePublicGrantFailure(t *testing.T) {
+	ctx := cloudy.StartContext()
+	fake, gcs := startFakeStorage(t)
+
+	// The bucket is removed again when the public grant fails, so creation can be retried
+	fake.staleIAMWrites = MaxPolicyUpdateAttempts
+	_, err := gcs.Create(ctx, "public", true, nil)
+	assert.True(t, IsPreconditionFailed(err))
+	exists, err := gcs.Exists(ctx, "public")
+	assert.Nil(t, err)
+	assert.False(t, exists)
+
+	_, err = gcs.Create(ctx, "public", true, nil)
+	assert.Nil(t, err)
+}
+
+func TestListPublicAccessUnknown(t *testing.T) {
+	ctx := cloudy.StartContext()
+	fake, gcs := startFakeStorage(t)
+
+	_, err := gcs.Create(ctx, "public", true, nil)
+	assert.Nil(t, err)
+	_, err = gcs.Create(ctx, "restricted", true, nil)
+	assert.Nil(t, err)
+
+	// Buckets whose policy cannot be read are listed without the tag
+	fake.failPolicyReads("restricted", http.StatusForbidden)
+	areas, err := gcs.List(ctx)
+	assert.Nil(t, err)
+	tags := map[string]map[string]string{}
+	for _, area := range areas {
+		tags[area.Name] = area.Tags
+	}
+	assert.Equal(t, map[string]map[string]string{
+		"public":     {PublicAccessTag: "true"},
+		"restricted": {},
+	}, tags)
+
+	area, err := gcs.GetItem(ctx, "restricted")
+	assert.Nil(t, err)
+	assert.NotContains(t, area.Tags, PublicAccessTag)
+}
+
 // func TestBlobFileAccount(t *testing.T) {
 // 	ctx := cloudy.StartContext()
-// 	bfa, err := NewGoogleCloudStorage(ctx, "arklouddev")
+// 	bfa, err := NewGoogleCloudStorage(ctx, "arklouddev", GcpCredentials{})
 // 	if err != nil {
 // 		log.Fatal(err)
 // 		// t.FailNow()